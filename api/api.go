@@ -0,0 +1,304 @@
+// Package api exposes vulcand's configuration backend over HTTP so
+// operators and tooling can manage hosts, locations, upstreams and
+// endpoints without touching etcd directly.
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	log "github.com/mailgun/gotools-log"
+	. "github.com/mailgun/vulcand/backend"
+	"github.com/mailgun/vulcand/middleware"
+)
+
+// ProxyController wires the backend to a set of HTTP handlers.
+type ProxyController struct {
+	backend Backend
+}
+
+// InitProxyController registers the controller's routes on router.
+func InitProxyController(backend Backend, router *mux.Router) {
+	c := &ProxyController{backend: backend}
+
+	router.HandleFunc("/v1/hosts", c.GetHosts).Methods("GET")
+	router.HandleFunc("/v1/hosts", c.AddHost).Methods("POST")
+	router.HandleFunc("/v1/hosts/{host}", c.DeleteHost).Methods("DELETE")
+
+	router.HandleFunc("/v1/hosts/{host}/locations", c.AddLocation).Methods("POST")
+	router.HandleFunc("/v1/hosts/{host}/locations/{location}", c.DeleteLocation).Methods("DELETE")
+
+	router.HandleFunc("/v1/upstreams", c.AddUpstream).Methods("POST")
+	router.HandleFunc("/v1/upstreams/{upstream}", c.DeleteUpstream).Methods("DELETE")
+
+	router.HandleFunc("/v1/upstreams/{upstream}/endpoints", c.AddEndpoint).Methods("POST")
+	router.HandleFunc("/v1/upstreams/{upstream}/endpoints/{endpoint}", c.DeleteEndpoint).Methods("DELETE")
+
+	router.HandleFunc("/v1/hosts/{host}/locations/{location}/ratelimits", c.AddRateLimit).Methods("POST")
+	router.HandleFunc("/v1/hosts/{host}/locations/{location}/ratelimits/{ratelimit}", c.DeleteRateLimit).Methods("DELETE")
+
+	router.HandleFunc("/v1/upstreams/{upstream}/healthcheck", c.SetHealthCheck).Methods("PUT")
+	router.HandleFunc("/v1/upstreams/{upstream}/healthcheck", c.DeleteHealthCheck).Methods("DELETE")
+
+	router.HandleFunc("/v1/hosts/{host}/locations/{location}/middlewares", c.AddMiddleware).Methods("POST")
+	router.HandleFunc("/v1/hosts/{host}/locations/{location}/middlewares/{middleware}", c.DeleteMiddleware).Methods("DELETE")
+
+	router.HandleFunc("/v1/hosts/{host}/locations/{location}/failover", c.SetFailover).Methods("PUT")
+	router.HandleFunc("/v1/hosts/{host}/locations/{location}/failover", c.DeleteFailover).Methods("DELETE")
+}
+
+func (c *ProxyController) GetHosts(w http.ResponseWriter, r *http.Request) {
+	hosts, err := c.backend.GetHosts()
+	if err != nil {
+		replyError(w, err)
+		return
+	}
+	replyOk(w, hosts)
+}
+
+func (c *ProxyController) AddHost(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	host, err := c.backend.AddHost(name)
+	if err != nil {
+		replyError(w, err)
+		return
+	}
+	replyOk(w, host)
+}
+
+func (c *ProxyController) DeleteHost(w http.ResponseWriter, r *http.Request) {
+	if err := c.backend.DeleteHost(mux.Vars(r)["host"]); err != nil {
+		replyError(w, err)
+		return
+	}
+	replyOk(w, "deleted")
+}
+
+func (c *ProxyController) AddLocation(w http.ResponseWriter, r *http.Request) {
+	loc, err := c.backend.AddLocation(
+		mux.Vars(r)["host"], r.FormValue("id"), r.FormValue("path"), r.FormValue("upstream"))
+	if err != nil {
+		replyError(w, err)
+		return
+	}
+	replyOk(w, loc)
+}
+
+func (c *ProxyController) DeleteLocation(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := c.backend.DeleteLocation(vars["host"], vars["location"]); err != nil {
+		replyError(w, err)
+		return
+	}
+	replyOk(w, "deleted")
+}
+
+func (c *ProxyController) AddUpstream(w http.ResponseWriter, r *http.Request) {
+	upstream, err := c.backend.AddUpstream(r.FormValue("id"))
+	if err != nil {
+		replyError(w, err)
+		return
+	}
+	replyOk(w, upstream)
+}
+
+func (c *ProxyController) DeleteUpstream(w http.ResponseWriter, r *http.Request) {
+	if err := c.backend.DeleteUpstream(mux.Vars(r)["upstream"]); err != nil {
+		replyError(w, err)
+		return
+	}
+	replyOk(w, "deleted")
+}
+
+func (c *ProxyController) AddEndpoint(w http.ResponseWriter, r *http.Request) {
+	endpoint, err := c.backend.AddEndpoint(
+		mux.Vars(r)["upstream"], r.FormValue("id"), r.FormValue("url"))
+	if err != nil {
+		replyError(w, err)
+		return
+	}
+	replyOk(w, endpoint)
+}
+
+func (c *ProxyController) DeleteEndpoint(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := c.backend.DeleteEndpoint(vars["upstream"], vars["endpoint"]); err != nil {
+		replyError(w, err)
+		return
+	}
+	replyOk(w, "deleted")
+}
+
+func (c *ProxyController) AddRateLimit(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	requests, err := strconv.Atoi(r.FormValue("requests"))
+	if err != nil {
+		replyError(w, err)
+		return
+	}
+	period, err := strconv.Atoi(r.FormValue("period_seconds"))
+	if err != nil {
+		replyError(w, err)
+		return
+	}
+	burst, _ := strconv.Atoi(r.FormValue("burst"))
+	rl := &RateLimit{
+		Requests:      requests,
+		PeriodSeconds: period,
+		Burst:         burst,
+		Variable:      r.FormValue("variable"),
+	}
+	rl, err = c.backend.AddRateLimit(vars["host"], vars["location"], r.FormValue("id"), rl)
+	if err != nil {
+		replyError(w, err)
+		return
+	}
+	replyOk(w, rl)
+}
+
+func (c *ProxyController) DeleteRateLimit(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := c.backend.DeleteRateLimit(vars["host"], vars["location"], vars["ratelimit"]); err != nil {
+		replyError(w, err)
+		return
+	}
+	replyOk(w, "deleted")
+}
+
+func (c *ProxyController) SetHealthCheck(w http.ResponseWriter, r *http.Request) {
+	expectedStatus, err := strconv.Atoi(r.FormValue("expected_status_code"))
+	if err != nil {
+		replyError(w, err)
+		return
+	}
+	interval, err := strconv.Atoi(r.FormValue("interval_ms"))
+	if err != nil {
+		replyError(w, err)
+		return
+	}
+	timeout, err := strconv.Atoi(r.FormValue("timeout_ms"))
+	if err != nil {
+		replyError(w, err)
+		return
+	}
+	unhealthy, _ := strconv.Atoi(r.FormValue("unhealthy_threshold"))
+	if unhealthy <= 0 {
+		unhealthy = 2
+	}
+	healthy, _ := strconv.Atoi(r.FormValue("healthy_threshold"))
+	if healthy <= 0 {
+		healthy = 2
+	}
+	hc := &HealthCheck{
+		Path:                    r.FormValue("path"),
+		ExpectedStatusCode:      expectedStatus,
+		IntervalMs:              interval,
+		TimeoutMs:               timeout,
+		UnhealthyThreshold:      unhealthy,
+		HealthyThreshold:        healthy,
+		AllowRemoveLastEndpoint: r.FormValue("allow_remove_last_endpoint") == "true",
+	}
+	hc, err = c.backend.SetHealthCheck(mux.Vars(r)["upstream"], hc)
+	if err != nil {
+		replyError(w, err)
+		return
+	}
+	replyOk(w, hc)
+}
+
+func (c *ProxyController) DeleteHealthCheck(w http.ResponseWriter, r *http.Request) {
+	if err := c.backend.DeleteHealthCheck(mux.Vars(r)["upstream"]); err != nil {
+		replyError(w, err)
+		return
+	}
+	replyOk(w, "deleted")
+}
+
+func (c *ProxyController) AddMiddleware(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	priority, _ := strconv.Atoi(r.FormValue("priority"))
+	mwType := r.FormValue("type")
+	spec := []byte(r.FormValue("spec"))
+
+	if err := middleware.Validate(mwType, spec); err != nil {
+		replyError(w, err)
+		return
+	}
+
+	m := &Middleware{Type: mwType, Priority: priority, Spec: spec}
+	m, err := c.backend.AddMiddleware(vars["host"], vars["location"], r.FormValue("id"), m)
+	if err != nil {
+		replyError(w, err)
+		return
+	}
+	replyOk(w, m)
+}
+
+func (c *ProxyController) DeleteMiddleware(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := c.backend.DeleteMiddleware(vars["host"], vars["location"], vars["middleware"]); err != nil {
+		replyError(w, err)
+		return
+	}
+	replyOk(w, "deleted")
+}
+
+func (c *ProxyController) SetFailover(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	maxAttempts, err := strconv.Atoi(r.FormValue("max_attempts"))
+	if err != nil {
+		replyError(w, err)
+		return
+	}
+	perTryTimeout, _ := strconv.Atoi(r.FormValue("per_try_timeout_ms"))
+	hedgeAfter, _ := strconv.Atoi(r.FormValue("hedge_after_ms"))
+	maxBodyBytes, _ := strconv.ParseInt(r.FormValue("max_body_bytes"), 10, 64)
+	maxBodyMemoryBytes, _ := strconv.ParseInt(r.FormValue("max_body_memory_bytes"), 10, 64)
+
+	retryOn := r.Form["retry_on"]
+	if len(retryOn) == 0 && r.FormValue("retry_on") != "" {
+		retryOn = strings.Split(r.FormValue("retry_on"), ",")
+	}
+
+	f := &Failover{
+		MaxAttempts:        maxAttempts,
+		RetryOn:            retryOn,
+		PerTryTimeoutMs:    perTryTimeout,
+		HedgeAfterMs:       hedgeAfter,
+		MaxBodyBytes:       maxBodyBytes,
+		MaxBodyMemoryBytes: maxBodyMemoryBytes,
+	}
+	f, err = c.backend.SetFailover(vars["host"], vars["location"], f)
+	if err != nil {
+		replyError(w, err)
+		return
+	}
+	replyOk(w, f)
+}
+
+func (c *ProxyController) DeleteFailover(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := c.backend.DeleteFailover(vars["host"], vars["location"]); err != nil {
+		replyError(w, err)
+		return
+	}
+	replyOk(w, "deleted")
+}
+
+func replyOk(w http.ResponseWriter, body interface{}) {
+	reply(w, http.StatusOK, body)
+}
+
+func replyError(w http.ResponseWriter, err error) {
+	log.Errorf("API request failed: %s", err)
+	reply(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+}
+
+func reply(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
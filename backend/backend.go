@@ -0,0 +1,220 @@
+// Package backend defines the data model vulcand stores in its configuration
+// backend (etcd by default) and the Backend interface used by the service
+// and API layers to read and mutate that model.
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Backend type names accepted by Options.BackendType.
+const (
+	EtcdBackendType = "etcd"
+	FileBackendType = "file"
+)
+
+// Backend is the interface implemented by configuration stores. The etcd
+// backend is the reference implementation; other stores can be plugged in
+// as long as they satisfy this interface.
+type Backend interface {
+	GetHosts() ([]*Host, error)
+
+	AddHost(name string) (*Host, error)
+	DeleteHost(name string) error
+
+	AddLocation(hostname, id, path, upstreamId string) (*Location, error)
+	DeleteLocation(hostname, id string) error
+
+	AddUpstream(id string) (*Upstream, error)
+	DeleteUpstream(id string) error
+
+	AddEndpoint(upstreamId, id, url string) (*Endpoint, error)
+	DeleteEndpoint(upstreamId, id string) error
+
+	AddRateLimit(hostname, locationId, id string, rl *RateLimit) (*RateLimit, error)
+	DeleteRateLimit(hostname, locationId, id string) error
+
+	SetHealthCheck(upstreamId string, hc *HealthCheck) (*HealthCheck, error)
+	DeleteHealthCheck(upstreamId string) error
+
+	AddMiddleware(hostname, locationId, id string, m *Middleware) (*Middleware, error)
+	DeleteMiddleware(hostname, locationId, id string) error
+
+	SetFailover(hostname, locationId string, f *Failover) (*Failover, error)
+	DeleteFailover(hostname, locationId string) error
+
+	// Close stops the backend's watch for changes. It does not close the
+	// changes channel, which is owned by the caller.
+	Close() error
+}
+
+// Options holds the knobs used to start vulcand: where the backend lives,
+// and what interfaces the proxy and API listen on.
+type Options struct {
+	// BackendType selects the configuration store implementation: one of
+	// EtcdBackendType (the default) or FileBackendType.
+	BackendType string
+
+	EtcdNodes       []string
+	EtcdKey         string
+	EtcdConsistency string
+
+	// FilePath is the config file watched by the file backend.
+	FilePath string
+
+	PidPath string
+
+	Interface string
+	Port      int
+
+	ApiInterface string
+	ApiPort      int
+
+	// GracefulTimeout bounds how long a shutdown or reload waits for
+	// in-flight requests to finish before the listeners are torn down
+	// regardless. Defaults to 30s when zero.
+	GracefulTimeout time.Duration
+}
+
+// Host represents a virtual host, e.g. "example.com", grouping locations
+// that share the same hostname.
+type Host struct {
+	Name      string      `json:"name"`
+	Locations []*Location `json:"locations,omitempty"`
+}
+
+func (h *Host) String() string {
+	return fmt.Sprintf("host(name=%s)", h.Name)
+}
+
+// Location represents a path matcher within a Host, e.g. "/api", backed by
+// a single Upstream.
+type Location struct {
+	Hostname    string        `json:"hostname"`
+	Name        string        `json:"name"`
+	Path        string        `json:"path"`
+	Upstream    *Upstream     `json:"upstream,omitempty"`
+	RateLimits  []*RateLimit  `json:"ratelimits,omitempty"`
+	Middlewares []*Middleware `json:"middlewares,omitempty"`
+	Failover    *Failover     `json:"failover,omitempty"`
+}
+
+func (l *Location) String() string {
+	return fmt.Sprintf("location(name=%s, path=%s)", l.Name, l.Path)
+}
+
+// RateLimit caps the rate of requests a Location accepts, bucketed by
+// Variable (e.g. "client.ip" or "request.header.X-Api-Key"). Requests over
+// the limit are rejected with 429 before they reach the upstream.
+type RateLimit struct {
+	Id            string `json:"id"`
+	Requests      int    `json:"requests"`
+	PeriodSeconds int    `json:"period_seconds"`
+	Burst         int    `json:"burst"`
+	Variable      string `json:"variable"`
+}
+
+func (r *RateLimit) String() string {
+	return fmt.Sprintf("ratelimit(id=%s, requests=%d, period=%ds, burst=%d, variable=%s)",
+		r.Id, r.Requests, r.PeriodSeconds, r.Burst, r.Variable)
+}
+
+// Middleware is a pluggable request/response transform attached to a
+// Location. Type selects the implementation from the middleware registry
+// (see package middleware), and Spec is its type-specific configuration,
+// stored and transmitted as opaque JSON. Priority controls execution order
+// within a location: lower runs first on the way in, last on the way out.
+type Middleware struct {
+	Id       string          `json:"id"`
+	Type     string          `json:"type"`
+	Priority int             `json:"priority"`
+	Spec     json.RawMessage `json:"spec,omitempty"`
+}
+
+func (m *Middleware) String() string {
+	return fmt.Sprintf("middleware(id=%s, type=%s, priority=%d)", m.Id, m.Type, m.Priority)
+}
+
+// Failover configures request retries for a Location. RetryOn is a set of
+// conditions ("connect_error", "read_timeout", "5xx", or "http:502,503,504")
+// that make an attempt eligible for retry, up to MaxAttempts total tries.
+// MaxBodyBytes caps the size of a request body vulcand will accept at all;
+// bodies up to MaxBodyMemoryBytes are buffered in memory so they can be
+// replayed on retry, larger ones spill to disk.
+type Failover struct {
+	MaxAttempts        int      `json:"max_attempts"`
+	RetryOn            []string `json:"retry_on"`
+	PerTryTimeoutMs    int      `json:"per_try_timeout_ms"`
+	HedgeAfterMs       int      `json:"hedge_after_ms"`
+	MaxBodyBytes       int64    `json:"max_body_bytes"`
+	MaxBodyMemoryBytes int64    `json:"max_body_memory_bytes"`
+}
+
+func (f *Failover) String() string {
+	return fmt.Sprintf("failover(max_attempts=%d, retry_on=%v)", f.MaxAttempts, f.RetryOn)
+}
+
+// Upstream is a named pool of Endpoints that a Location load balances across.
+type Upstream struct {
+	Name        string       `json:"name"`
+	Endpoints   []*Endpoint  `json:"endpoints,omitempty"`
+	HealthCheck *HealthCheck `json:"healthcheck,omitempty"`
+}
+
+func (u *Upstream) String() string {
+	return fmt.Sprintf("upstream(name=%s)", u.Name)
+}
+
+// HealthCheck configures active probing of an Upstream's endpoints. When
+// set, vulcand periodically issues an HTTP GET against Path on every
+// endpoint and ejects it from the load balancer once UnhealthyThreshold
+// consecutive probes fail, restoring it after HealthyThreshold consecutive
+// successes.
+type HealthCheck struct {
+	Path                    string `json:"path"`
+	ExpectedStatusCode      int    `json:"expected_status_code"`
+	IntervalMs              int    `json:"interval_ms"`
+	TimeoutMs               int    `json:"timeout_ms"`
+	UnhealthyThreshold      int    `json:"unhealthy_threshold"`
+	HealthyThreshold        int    `json:"healthy_threshold"`
+	AllowRemoveLastEndpoint bool   `json:"allow_remove_last_endpoint"`
+}
+
+func (hc *HealthCheck) String() string {
+	return fmt.Sprintf("healthcheck(path=%s, expect=%d, interval=%dms)",
+		hc.Path, hc.ExpectedStatusCode, hc.IntervalMs)
+}
+
+// Endpoint is a single backend server that can serve traffic for an Upstream.
+type Endpoint struct {
+	UpstreamId string `json:"upstream_id,omitempty"`
+	Name       string `json:"name"`
+	Url        string `json:"url"`
+}
+
+func (e *Endpoint) String() string {
+	return fmt.Sprintf("endpoint(name=%s, url=%s)", e.Name, e.Url)
+}
+
+// ResyncAction marks a Change as a full-resync event: Child is the
+// complete, current []*Host snapshot rather than a single entity, and
+// Parent is unused. Backends that can't produce precise incremental
+// diffs (e.g. a file watcher that only knows "the file changed") emit
+// this instead, leaving the consumer to diff against its own state.
+const ResyncAction = "resync"
+
+// Change is emitted by a Backend whenever the underlying configuration
+// changes. Child identifies what changed, Parent gives enough context to
+// locate it (e.g. the Upstream an Endpoint belongs to), and Action is one
+// of "create", "update", "delete", or ResyncAction.
+type Change struct {
+	Action string
+	Parent interface{}
+	Child  interface{}
+}
+
+func (c *Change) String() string {
+	return fmt.Sprintf("change(action=%s, parent=%v, child=%v)", c.Action, c.Parent, c.Child)
+}
@@ -0,0 +1,125 @@
+package backend
+
+import "testing"
+
+// RunConformanceSuite exercises the full Backend interface against a
+// freshly created backend, so any new implementation can be checked with:
+//
+//	func TestMyBackend(t *testing.T) {
+//		backend.RunConformanceSuite(t, func() (backend.Backend, func()) {
+//			... return a fresh backend and a cleanup func
+//		})
+//	}
+func RunConformanceSuite(t *testing.T, newBackend func() (Backend, func())) {
+	b, cleanup := newBackend()
+	defer cleanup()
+
+	if _, err := b.AddHost("example.com"); err != nil {
+		t.Fatalf("AddHost: %s", err)
+	}
+	if _, err := b.AddUpstream("up1"); err != nil {
+		t.Fatalf("AddUpstream: %s", err)
+	}
+	if _, err := b.AddEndpoint("up1", "e1", "http://127.0.0.1:5000"); err != nil {
+		t.Fatalf("AddEndpoint: %s", err)
+	}
+	if _, err := b.AddLocation("example.com", "l1", "/api", "up1"); err != nil {
+		t.Fatalf("AddLocation: %s", err)
+	}
+
+	hosts, err := b.GetHosts()
+	if err != nil {
+		t.Fatalf("GetHosts: %s", err)
+	}
+	loc := findLocation(t, hosts, "example.com", "l1")
+	if loc.Path != "/api" {
+		t.Fatalf("expected path /api, got %s", loc.Path)
+	}
+	if loc.Upstream == nil || len(loc.Upstream.Endpoints) != 1 || loc.Upstream.Endpoints[0].Url != "http://127.0.0.1:5000" {
+		t.Fatalf("expected location to resolve upstream endpoints, got %+v", loc.Upstream)
+	}
+
+	if _, err := b.AddRateLimit("example.com", "l1", "r1", &RateLimit{Requests: 10, PeriodSeconds: 1, Burst: 10, Variable: "client.ip"}); err != nil {
+		t.Fatalf("AddRateLimit: %s", err)
+	}
+	if _, err := b.AddMiddleware("example.com", "l1", "m1", &Middleware{Type: "header.rewrite", Priority: 1, Spec: []byte(`{"Header":"X-Test","Value":"1"}`)}); err != nil {
+		t.Fatalf("AddMiddleware: %s", err)
+	}
+	if _, err := b.SetFailover("example.com", "l1", &Failover{MaxAttempts: 2, RetryOn: []string{"5xx"}}); err != nil {
+		t.Fatalf("SetFailover: %s", err)
+	}
+	if _, err := b.SetHealthCheck("up1", &HealthCheck{Path: "/health", ExpectedStatusCode: 200}); err != nil {
+		t.Fatalf("SetHealthCheck: %s", err)
+	}
+
+	hosts, err = b.GetHosts()
+	if err != nil {
+		t.Fatalf("GetHosts: %s", err)
+	}
+	loc = findLocation(t, hosts, "example.com", "l1")
+	if len(loc.RateLimits) != 1 {
+		t.Fatalf("expected 1 ratelimit, got %d", len(loc.RateLimits))
+	}
+	if len(loc.Middlewares) != 1 {
+		t.Fatalf("expected 1 middleware, got %d", len(loc.Middlewares))
+	}
+	if loc.Failover == nil || loc.Failover.MaxAttempts != 2 {
+		t.Fatalf("expected failover to be set, got %+v", loc.Failover)
+	}
+	if loc.Upstream.HealthCheck == nil || loc.Upstream.HealthCheck.Path != "/health" {
+		t.Fatalf("expected healthcheck to be set, got %+v", loc.Upstream.HealthCheck)
+	}
+
+	if err := b.DeleteRateLimit("example.com", "l1", "r1"); err != nil {
+		t.Fatalf("DeleteRateLimit: %s", err)
+	}
+	if err := b.DeleteMiddleware("example.com", "l1", "m1"); err != nil {
+		t.Fatalf("DeleteMiddleware: %s", err)
+	}
+	if err := b.DeleteFailover("example.com", "l1"); err != nil {
+		t.Fatalf("DeleteFailover: %s", err)
+	}
+	if err := b.DeleteHealthCheck("up1"); err != nil {
+		t.Fatalf("DeleteHealthCheck: %s", err)
+	}
+	if err := b.DeleteEndpoint("up1", "e1"); err != nil {
+		t.Fatalf("DeleteEndpoint: %s", err)
+	}
+	if err := b.DeleteLocation("example.com", "l1"); err != nil {
+		t.Fatalf("DeleteLocation: %s", err)
+	}
+	if err := b.DeleteUpstream("up1"); err != nil {
+		t.Fatalf("DeleteUpstream: %s", err)
+	}
+	if err := b.DeleteHost("example.com"); err != nil {
+		t.Fatalf("DeleteHost: %s", err)
+	}
+
+	hosts, err = b.GetHosts()
+	if err != nil {
+		t.Fatalf("GetHosts: %s", err)
+	}
+	if len(hosts) != 0 {
+		t.Fatalf("expected no hosts after cleanup, got %d", len(hosts))
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+}
+
+func findLocation(t *testing.T, hosts []*Host, hostname, name string) *Location {
+	t.Helper()
+	for _, h := range hosts {
+		if h.Name != hostname {
+			continue
+		}
+		for _, l := range h.Locations {
+			if l.Name == name {
+				return l
+			}
+		}
+	}
+	t.Fatalf("location %s not found in %s", name, hostname)
+	return nil
+}
@@ -0,0 +1,461 @@
+package backend
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-etcd/etcd"
+	log "github.com/mailgun/gotools-log"
+)
+
+// EtcdBackend is the reference Backend implementation, storing the
+// configuration tree under a single etcd key prefix:
+//
+//	<key>/hosts/<hostname>/locations/<id>
+//	<key>/upstreams/<id>/endpoints/<id>
+type EtcdBackend struct {
+	client      *etcd.Client
+	key         string
+	consistency string
+	changes     chan *Change
+	stop        chan bool
+}
+
+// NewEtcdBackend connects to the given etcd nodes and starts watching
+// <key> for changes, publishing them on changes.
+func NewEtcdBackend(nodes []string, key, consistency string, changes chan *Change) (*EtcdBackend, error) {
+	client := etcd.NewClient(nodes)
+	if err := client.SetConsistency(consistency); err != nil {
+		return nil, fmt.Errorf("failed to set etcd consistency: %s", err)
+	}
+	b := &EtcdBackend{
+		client:      client,
+		key:         key,
+		consistency: consistency,
+		changes:     changes,
+		stop:        make(chan bool),
+	}
+	go b.watch()
+	return b, nil
+}
+
+func (b *EtcdBackend) path(parts ...string) string {
+	path := b.key
+	for _, p := range parts {
+		path = path + "/" + p
+	}
+	return path
+}
+
+// watch blocks on etcd's recursive watch of key and, on every event,
+// reloads the whole tree and republishes it as a ResyncAction. A single
+// etcd watch response only ever names the one key that changed (e.g.
+// ".../ratelimits/r1/burst"), which isn't enough context on its own to
+// rebuild the RateLimit/Middleware/Failover/HealthCheck it belongs to
+// without another round trip anyway, so resync is used here the same way
+// the file backend uses it: the caller diffs the fresh snapshot against
+// what it already applied and issues the minimal add/delete calls.
+func (b *EtcdBackend) watch() {
+	for {
+		_, err := b.client.Watch(b.key, 0, true, nil, b.stop)
+		if err != nil {
+			if err == etcd.ErrWatchStoppedByUser {
+				return
+			}
+			log.Errorf("Watch failed: %s", err)
+			continue
+		}
+		hosts, err := b.GetHosts()
+		if err != nil {
+			log.Errorf("Failed to reload hosts after watch event: %s", err)
+			continue
+		}
+		b.changes <- &Change{Action: ResyncAction, Child: hosts}
+	}
+}
+
+// Close stops the watch goroutine by closing the stop channel passed to
+// the underlying etcd watch.
+func (b *EtcdBackend) Close() error {
+	close(b.stop)
+	return nil
+}
+
+func (b *EtcdBackend) GetHosts() ([]*Host, error) {
+	response, err := b.client.Get(b.path("hosts"), false, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hosts: %s", err)
+	}
+	out := []*Host{}
+	if response.Node == nil {
+		return out, nil
+	}
+	for _, hostNode := range response.Node.Nodes {
+		host, err := b.readHost(hostNode)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, host)
+	}
+	return out, nil
+}
+
+func (b *EtcdBackend) readHost(hostNode *etcd.Node) (*Host, error) {
+	host := &Host{Name: suffix(hostNode.Key)}
+	for _, n := range hostNode.Nodes {
+		if suffix(n.Key) != "locations" {
+			continue
+		}
+		for _, locNode := range n.Nodes {
+			loc, err := b.readLocation(host.Name, locNode)
+			if err != nil {
+				return nil, err
+			}
+			host.Locations = append(host.Locations, loc)
+		}
+	}
+	return host, nil
+}
+
+func (b *EtcdBackend) readLocation(hostname string, locNode *etcd.Node) (*Location, error) {
+	loc := &Location{Hostname: hostname, Name: suffix(locNode.Key)}
+	var path, upstreamId string
+	for _, n := range locNode.Nodes {
+		switch suffix(n.Key) {
+		case "path":
+			path = n.Value
+		case "upstream":
+			upstreamId = n.Value
+		}
+	}
+	loc.Path = path
+	upstream, err := b.getUpstream(upstreamId)
+	if err != nil {
+		return nil, err
+	}
+	loc.Upstream = upstream
+
+	for _, n := range locNode.Nodes {
+		switch suffix(n.Key) {
+		case "ratelimits":
+			for _, rlNode := range n.Nodes {
+				rl, err := readRateLimit(suffix(rlNode.Key), rlNode)
+				if err != nil {
+					return nil, err
+				}
+				loc.RateLimits = append(loc.RateLimits, rl)
+			}
+		case "middlewares":
+			for _, mwNode := range n.Nodes {
+				mw, err := readMiddleware(suffix(mwNode.Key), mwNode)
+				if err != nil {
+					return nil, err
+				}
+				loc.Middlewares = append(loc.Middlewares, mw)
+			}
+		case "failover":
+			f, err := readFailover(n)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read failover for location %s: %s", loc.Name, err)
+			}
+			loc.Failover = f
+		}
+	}
+	return loc, nil
+}
+
+func readFailover(n *etcd.Node) (*Failover, error) {
+	f := &Failover{}
+	for _, c := range n.Nodes {
+		var err error
+		switch suffix(c.Key) {
+		case "max_attempts":
+			f.MaxAttempts, err = strconv.Atoi(c.Value)
+		case "retry_on":
+			// An "http:502,503,504" condition holds commas of its own, so a
+			// bare status code continues the "http:" condition before it.
+			for _, cond := range strings.Split(c.Value, ",") {
+				last := len(f.RetryOn) - 1
+				if _, convErr := strconv.Atoi(cond); convErr == nil && last >= 0 && strings.HasPrefix(f.RetryOn[last], "http:") {
+					f.RetryOn[last] += "," + cond
+					continue
+				}
+				f.RetryOn = append(f.RetryOn, cond)
+			}
+		case "per_try_timeout_ms":
+			f.PerTryTimeoutMs, err = strconv.Atoi(c.Value)
+		case "hedge_after_ms":
+			f.HedgeAfterMs, err = strconv.Atoi(c.Value)
+		case "max_body_bytes":
+			f.MaxBodyBytes, err = strconv.ParseInt(c.Value, 10, 64)
+		case "max_body_memory_bytes":
+			f.MaxBodyMemoryBytes, err = strconv.ParseInt(c.Value, 10, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad value for %s: %s", c.Key, err)
+		}
+	}
+	return f, nil
+}
+
+func readMiddleware(id string, mwNode *etcd.Node) (*Middleware, error) {
+	mw := &Middleware{Id: id}
+	for _, f := range mwNode.Nodes {
+		switch suffix(f.Key) {
+		case "type":
+			mw.Type = f.Value
+		case "priority":
+			priority, err := strconv.Atoi(f.Value)
+			if err != nil {
+				return nil, fmt.Errorf("bad priority for middleware %s: %s", id, err)
+			}
+			mw.Priority = priority
+		case "spec":
+			mw.Spec = []byte(f.Value)
+		}
+	}
+	return mw, nil
+}
+
+func readRateLimit(id string, rlNode *etcd.Node) (*RateLimit, error) {
+	rl := &RateLimit{Id: id}
+	for _, n := range rlNode.Nodes {
+		switch suffix(n.Key) {
+		case "requests":
+			requests, err := strconv.Atoi(n.Value)
+			if err != nil {
+				return nil, fmt.Errorf("bad requests value for ratelimit %s: %s", id, err)
+			}
+			rl.Requests = requests
+		case "period_seconds":
+			period, err := strconv.Atoi(n.Value)
+			if err != nil {
+				return nil, fmt.Errorf("bad period_seconds value for ratelimit %s: %s", id, err)
+			}
+			rl.PeriodSeconds = period
+		case "burst":
+			burst, err := strconv.Atoi(n.Value)
+			if err != nil {
+				return nil, fmt.Errorf("bad burst value for ratelimit %s: %s", id, err)
+			}
+			rl.Burst = burst
+		case "variable":
+			rl.Variable = n.Value
+		}
+	}
+	return rl, nil
+}
+
+func (b *EtcdBackend) getUpstream(id string) (*Upstream, error) {
+	response, err := b.client.Get(b.path("upstreams", id), false, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get upstream %s: %s", id, err)
+	}
+	upstream := &Upstream{Name: id}
+	if response.Node == nil {
+		return upstream, nil
+	}
+	for _, n := range response.Node.Nodes {
+		switch suffix(n.Key) {
+		case "endpoints":
+			for _, epNode := range n.Nodes {
+				upstream.Endpoints = append(upstream.Endpoints, &Endpoint{
+					UpstreamId: id,
+					Name:       suffix(epNode.Key),
+					Url:        epNode.Value,
+				})
+			}
+		case "healthcheck":
+			hc, err := readHealthCheck(n)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read healthcheck for upstream %s: %s", id, err)
+			}
+			upstream.HealthCheck = hc
+		}
+	}
+	return upstream, nil
+}
+
+func readHealthCheck(n *etcd.Node) (*HealthCheck, error) {
+	hc := &HealthCheck{}
+	for _, f := range n.Nodes {
+		var err error
+		switch suffix(f.Key) {
+		case "path":
+			hc.Path = f.Value
+		case "expected_status_code":
+			hc.ExpectedStatusCode, err = strconv.Atoi(f.Value)
+		case "interval_ms":
+			hc.IntervalMs, err = strconv.Atoi(f.Value)
+		case "timeout_ms":
+			hc.TimeoutMs, err = strconv.Atoi(f.Value)
+		case "unhealthy_threshold":
+			hc.UnhealthyThreshold, err = strconv.Atoi(f.Value)
+		case "healthy_threshold":
+			hc.HealthyThreshold, err = strconv.Atoi(f.Value)
+		case "allow_remove_last_endpoint":
+			hc.AllowRemoveLastEndpoint = f.Value == "true"
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad value for %s: %s", f.Key, err)
+		}
+	}
+	return hc, nil
+}
+
+func (b *EtcdBackend) AddHost(name string) (*Host, error) {
+	if _, err := b.client.CreateDir(b.path("hosts", name), 0); err != nil {
+		return nil, fmt.Errorf("failed to create host %s: %s", name, err)
+	}
+	return &Host{Name: name}, nil
+}
+
+func (b *EtcdBackend) DeleteHost(name string) error {
+	_, err := b.client.Delete(b.path("hosts", name), true)
+	return err
+}
+
+func (b *EtcdBackend) AddLocation(hostname, id, path, upstreamId string) (*Location, error) {
+	base := b.path("hosts", hostname, "locations", id)
+	if _, err := b.client.Set(base+"/path", path, 0); err != nil {
+		return nil, fmt.Errorf("failed to set location path: %s", err)
+	}
+	if _, err := b.client.Set(base+"/upstream", upstreamId, 0); err != nil {
+		return nil, fmt.Errorf("failed to set location upstream: %s", err)
+	}
+	upstream, err := b.getUpstream(upstreamId)
+	if err != nil {
+		return nil, err
+	}
+	return &Location{Hostname: hostname, Name: id, Path: path, Upstream: upstream}, nil
+}
+
+func (b *EtcdBackend) DeleteLocation(hostname, id string) error {
+	_, err := b.client.Delete(b.path("hosts", hostname, "locations", id), true)
+	return err
+}
+
+func (b *EtcdBackend) AddUpstream(id string) (*Upstream, error) {
+	if _, err := b.client.CreateDir(b.path("upstreams", id), 0); err != nil {
+		return nil, fmt.Errorf("failed to create upstream %s: %s", id, err)
+	}
+	return &Upstream{Name: id}, nil
+}
+
+func (b *EtcdBackend) DeleteUpstream(id string) error {
+	_, err := b.client.Delete(b.path("upstreams", id), true)
+	return err
+}
+
+func (b *EtcdBackend) AddEndpoint(upstreamId, id, url string) (*Endpoint, error) {
+	key := b.path("upstreams", upstreamId, "endpoints", id)
+	if _, err := b.client.Set(key, url, 0); err != nil {
+		return nil, fmt.Errorf("failed to set endpoint %s: %s", id, err)
+	}
+	return &Endpoint{UpstreamId: upstreamId, Name: id, Url: url}, nil
+}
+
+func (b *EtcdBackend) DeleteEndpoint(upstreamId, id string) error {
+	_, err := b.client.Delete(b.path("upstreams", upstreamId, "endpoints", id), false)
+	return err
+}
+
+func (b *EtcdBackend) AddRateLimit(hostname, locationId, id string, rl *RateLimit) (*RateLimit, error) {
+	base := b.path("hosts", hostname, "locations", locationId, "ratelimits", id)
+	fields := map[string]string{
+		"requests":       strconv.Itoa(rl.Requests),
+		"period_seconds": strconv.Itoa(rl.PeriodSeconds),
+		"burst":          strconv.Itoa(rl.Burst),
+		"variable":       rl.Variable,
+	}
+	for name, value := range fields {
+		if _, err := b.client.Set(base+"/"+name, value, 0); err != nil {
+			return nil, fmt.Errorf("failed to set ratelimit %s/%s: %s", id, name, err)
+		}
+	}
+	rl.Id = id
+	return rl, nil
+}
+
+func (b *EtcdBackend) DeleteRateLimit(hostname, locationId, id string) error {
+	_, err := b.client.Delete(b.path("hosts", hostname, "locations", locationId, "ratelimits", id), true)
+	return err
+}
+
+func (b *EtcdBackend) SetHealthCheck(upstreamId string, hc *HealthCheck) (*HealthCheck, error) {
+	base := b.path("upstreams", upstreamId, "healthcheck")
+	fields := map[string]string{
+		"path":                       hc.Path,
+		"expected_status_code":       strconv.Itoa(hc.ExpectedStatusCode),
+		"interval_ms":                strconv.Itoa(hc.IntervalMs),
+		"timeout_ms":                 strconv.Itoa(hc.TimeoutMs),
+		"unhealthy_threshold":        strconv.Itoa(hc.UnhealthyThreshold),
+		"healthy_threshold":          strconv.Itoa(hc.HealthyThreshold),
+		"allow_remove_last_endpoint": strconv.FormatBool(hc.AllowRemoveLastEndpoint),
+	}
+	for name, value := range fields {
+		if _, err := b.client.Set(base+"/"+name, value, 0); err != nil {
+			return nil, fmt.Errorf("failed to set healthcheck %s/%s: %s", upstreamId, name, err)
+		}
+	}
+	return hc, nil
+}
+
+func (b *EtcdBackend) DeleteHealthCheck(upstreamId string) error {
+	_, err := b.client.Delete(b.path("upstreams", upstreamId, "healthcheck"), true)
+	return err
+}
+
+func (b *EtcdBackend) AddMiddleware(hostname, locationId, id string, m *Middleware) (*Middleware, error) {
+	base := b.path("hosts", hostname, "locations", locationId, "middlewares", id)
+	fields := map[string]string{
+		"type":     m.Type,
+		"priority": strconv.Itoa(m.Priority),
+		"spec":     string(m.Spec),
+	}
+	for name, value := range fields {
+		if _, err := b.client.Set(base+"/"+name, value, 0); err != nil {
+			return nil, fmt.Errorf("failed to set middleware %s/%s: %s", id, name, err)
+		}
+	}
+	m.Id = id
+	return m, nil
+}
+
+func (b *EtcdBackend) DeleteMiddleware(hostname, locationId, id string) error {
+	_, err := b.client.Delete(b.path("hosts", hostname, "locations", locationId, "middlewares", id), true)
+	return err
+}
+
+func (b *EtcdBackend) SetFailover(hostname, locationId string, f *Failover) (*Failover, error) {
+	base := b.path("hosts", hostname, "locations", locationId, "failover")
+	fields := map[string]string{
+		"max_attempts":          strconv.Itoa(f.MaxAttempts),
+		"retry_on":              strings.Join(f.RetryOn, ","),
+		"per_try_timeout_ms":    strconv.Itoa(f.PerTryTimeoutMs),
+		"hedge_after_ms":        strconv.Itoa(f.HedgeAfterMs),
+		"max_body_bytes":        strconv.FormatInt(f.MaxBodyBytes, 10),
+		"max_body_memory_bytes": strconv.FormatInt(f.MaxBodyMemoryBytes, 10),
+	}
+	for name, value := range fields {
+		if _, err := b.client.Set(base+"/"+name, value, 0); err != nil {
+			return nil, fmt.Errorf("failed to set failover %s/%s: %s", locationId, name, err)
+		}
+	}
+	return f, nil
+}
+
+func (b *EtcdBackend) DeleteFailover(hostname, locationId string) error {
+	_, err := b.client.Delete(b.path("hosts", hostname, "locations", locationId, "failover"), true)
+	return err
+}
+
+func suffix(key string) string {
+	for i := len(key) - 1; i >= 0; i-- {
+		if key[i] == '/' {
+			return key[i+1:]
+		}
+	}
+	return key
+}
@@ -0,0 +1,485 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/go-fsnotify/fsnotify"
+	log "github.com/mailgun/gotools-log"
+)
+
+// fileConfig is the on-disk shape of the file backend's config file: a
+// flat list of upstreams plus hosts whose locations reference them by id,
+// mirroring the tree the etcd backend keeps under its key prefix.
+type fileConfig struct {
+	Upstreams []*Upstream      `json:"upstreams"`
+	Hosts     []*fileHostEntry `json:"hosts"`
+}
+
+type fileHostEntry struct {
+	Name      string               `json:"name"`
+	Locations []*fileLocationEntry `json:"locations"`
+}
+
+type fileLocationEntry struct {
+	Name        string        `json:"name"`
+	Path        string        `json:"path"`
+	Upstream    string        `json:"upstream"`
+	RateLimits  []*RateLimit  `json:"ratelimits,omitempty"`
+	Middlewares []*Middleware `json:"middlewares,omitempty"`
+	Failover    *Failover     `json:"failover,omitempty"`
+}
+
+// FileBackend is a Backend implementation that keeps the configuration in
+// a single JSON file, picking up edits via fsnotify. It can't tell which
+// entity changed, so, like the etcd backend, it reports every edit as a
+// single ResyncAction carrying the full, fresh snapshot.
+type FileBackend struct {
+	path    string
+	changes chan *Change
+	watcher *fsnotify.Watcher
+
+	mu sync.Mutex
+}
+
+// NewFileBackend starts watching path for changes, publishing a
+// ResyncAction Change on changes every time it's modified.
+func NewFileBackend(path string, changes chan *Change) (*FileBackend, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("failed to stat config file %s: %s", path, err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file watcher: %s", err)
+	}
+	if err := watcher.Add(path); err != nil {
+		return nil, fmt.Errorf("failed to watch %s: %s", path, err)
+	}
+	b := &FileBackend{path: path, changes: changes, watcher: watcher}
+	go b.watch(watcher)
+	return b, nil
+}
+
+func (b *FileBackend) watch(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			hosts, err := b.GetHosts()
+			if err != nil {
+				log.Errorf("file backend: failed to reload %s: %s", b.path, err)
+				continue
+			}
+			b.changes <- &Change{Action: ResyncAction, Child: hosts}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("file backend: watch error: %s", err)
+		}
+	}
+}
+
+// Close stops the file watch. watch exits once watcher.Events is closed.
+func (b *FileBackend) Close() error {
+	return b.watcher.Close()
+}
+
+func (b *FileBackend) load() (*fileConfig, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.loadLocked()
+}
+
+func (b *FileBackend) loadLocked() (*fileConfig, error) {
+	data, err := ioutil.ReadFile(b.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", b.path, err)
+	}
+	cfg := &fileConfig{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %s", b.path, err)
+		}
+	}
+	return cfg, nil
+}
+
+func (b *FileBackend) saveLocked(cfg *fileConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(b.path, data, 0644)
+}
+
+func (b *FileBackend) GetHosts() ([]*Host, error) {
+	cfg, err := b.load()
+	if err != nil {
+		return nil, err
+	}
+	upstreams := make(map[string]*Upstream, len(cfg.Upstreams))
+	for _, u := range cfg.Upstreams {
+		upstreams[u.Name] = u
+	}
+	out := []*Host{}
+	for _, h := range cfg.Hosts {
+		host := &Host{Name: h.Name}
+		for _, l := range h.Locations {
+			host.Locations = append(host.Locations, &Location{
+				Hostname:    h.Name,
+				Name:        l.Name,
+				Path:        l.Path,
+				Upstream:    upstreams[l.Upstream],
+				RateLimits:  l.RateLimits,
+				Middlewares: l.Middlewares,
+				Failover:    l.Failover,
+			})
+		}
+		out = append(out, host)
+	}
+	return out, nil
+}
+
+func (b *FileBackend) findHost(cfg *fileConfig, name string) *fileHostEntry {
+	for _, h := range cfg.Hosts {
+		if h.Name == name {
+			return h
+		}
+	}
+	return nil
+}
+
+func (b *FileBackend) findLocation(h *fileHostEntry, id string) *fileLocationEntry {
+	for _, l := range h.Locations {
+		if l.Name == id {
+			return l
+		}
+	}
+	return nil
+}
+
+func (b *FileBackend) findUpstream(cfg *fileConfig, id string) *Upstream {
+	for _, u := range cfg.Upstreams {
+		if u.Name == id {
+			return u
+		}
+	}
+	return nil
+}
+
+func (b *FileBackend) AddHost(name string) (*Host, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cfg, err := b.loadLocked()
+	if err != nil {
+		return nil, err
+	}
+	if b.findHost(cfg, name) != nil {
+		return nil, fmt.Errorf("host %s already exists", name)
+	}
+	cfg.Hosts = append(cfg.Hosts, &fileHostEntry{Name: name})
+	if err := b.saveLocked(cfg); err != nil {
+		return nil, err
+	}
+	return &Host{Name: name}, nil
+}
+
+func (b *FileBackend) DeleteHost(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cfg, err := b.loadLocked()
+	if err != nil {
+		return err
+	}
+	out := cfg.Hosts[:0]
+	for _, h := range cfg.Hosts {
+		if h.Name != name {
+			out = append(out, h)
+		}
+	}
+	cfg.Hosts = out
+	return b.saveLocked(cfg)
+}
+
+func (b *FileBackend) AddLocation(hostname, id, path, upstreamId string) (*Location, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cfg, err := b.loadLocked()
+	if err != nil {
+		return nil, err
+	}
+	h := b.findHost(cfg, hostname)
+	if h == nil {
+		return nil, fmt.Errorf("host %s not found", hostname)
+	}
+	h.Locations = append(h.Locations, &fileLocationEntry{Name: id, Path: path, Upstream: upstreamId})
+	if err := b.saveLocked(cfg); err != nil {
+		return nil, err
+	}
+	return &Location{Hostname: hostname, Name: id, Path: path, Upstream: b.findUpstream(cfg, upstreamId)}, nil
+}
+
+func (b *FileBackend) DeleteLocation(hostname, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cfg, err := b.loadLocked()
+	if err != nil {
+		return err
+	}
+	h := b.findHost(cfg, hostname)
+	if h == nil {
+		return fmt.Errorf("host %s not found", hostname)
+	}
+	out := h.Locations[:0]
+	for _, l := range h.Locations {
+		if l.Name != id {
+			out = append(out, l)
+		}
+	}
+	h.Locations = out
+	return b.saveLocked(cfg)
+}
+
+func (b *FileBackend) AddUpstream(id string) (*Upstream, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cfg, err := b.loadLocked()
+	if err != nil {
+		return nil, err
+	}
+	if b.findUpstream(cfg, id) != nil {
+		return nil, fmt.Errorf("upstream %s already exists", id)
+	}
+	u := &Upstream{Name: id}
+	cfg.Upstreams = append(cfg.Upstreams, u)
+	if err := b.saveLocked(cfg); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (b *FileBackend) DeleteUpstream(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cfg, err := b.loadLocked()
+	if err != nil {
+		return err
+	}
+	out := cfg.Upstreams[:0]
+	for _, u := range cfg.Upstreams {
+		if u.Name != id {
+			out = append(out, u)
+		}
+	}
+	cfg.Upstreams = out
+	return b.saveLocked(cfg)
+}
+
+func (b *FileBackend) AddEndpoint(upstreamId, id, url string) (*Endpoint, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cfg, err := b.loadLocked()
+	if err != nil {
+		return nil, err
+	}
+	u := b.findUpstream(cfg, upstreamId)
+	if u == nil {
+		return nil, fmt.Errorf("upstream %s not found", upstreamId)
+	}
+	e := &Endpoint{UpstreamId: upstreamId, Name: id, Url: url}
+	u.Endpoints = append(u.Endpoints, e)
+	if err := b.saveLocked(cfg); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (b *FileBackend) DeleteEndpoint(upstreamId, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cfg, err := b.loadLocked()
+	if err != nil {
+		return err
+	}
+	u := b.findUpstream(cfg, upstreamId)
+	if u == nil {
+		return fmt.Errorf("upstream %s not found", upstreamId)
+	}
+	out := u.Endpoints[:0]
+	for _, e := range u.Endpoints {
+		if e.Name != id {
+			out = append(out, e)
+		}
+	}
+	u.Endpoints = out
+	return b.saveLocked(cfg)
+}
+
+func (b *FileBackend) AddRateLimit(hostname, locationId, id string, rl *RateLimit) (*RateLimit, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cfg, err := b.loadLocked()
+	if err != nil {
+		return nil, err
+	}
+	l, err := b.locationOrErr(cfg, hostname, locationId)
+	if err != nil {
+		return nil, err
+	}
+	rl.Id = id
+	l.RateLimits = append(l.RateLimits, rl)
+	if err := b.saveLocked(cfg); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+func (b *FileBackend) DeleteRateLimit(hostname, locationId, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cfg, err := b.loadLocked()
+	if err != nil {
+		return err
+	}
+	l, err := b.locationOrErr(cfg, hostname, locationId)
+	if err != nil {
+		return err
+	}
+	out := l.RateLimits[:0]
+	for _, rl := range l.RateLimits {
+		if rl.Id != id {
+			out = append(out, rl)
+		}
+	}
+	l.RateLimits = out
+	return b.saveLocked(cfg)
+}
+
+func (b *FileBackend) AddMiddleware(hostname, locationId, id string, m *Middleware) (*Middleware, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cfg, err := b.loadLocked()
+	if err != nil {
+		return nil, err
+	}
+	l, err := b.locationOrErr(cfg, hostname, locationId)
+	if err != nil {
+		return nil, err
+	}
+	m.Id = id
+	l.Middlewares = append(l.Middlewares, m)
+	if err := b.saveLocked(cfg); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (b *FileBackend) DeleteMiddleware(hostname, locationId, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cfg, err := b.loadLocked()
+	if err != nil {
+		return err
+	}
+	l, err := b.locationOrErr(cfg, hostname, locationId)
+	if err != nil {
+		return err
+	}
+	out := l.Middlewares[:0]
+	for _, m := range l.Middlewares {
+		if m.Id != id {
+			out = append(out, m)
+		}
+	}
+	l.Middlewares = out
+	return b.saveLocked(cfg)
+}
+
+func (b *FileBackend) SetFailover(hostname, locationId string, f *Failover) (*Failover, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cfg, err := b.loadLocked()
+	if err != nil {
+		return nil, err
+	}
+	l, err := b.locationOrErr(cfg, hostname, locationId)
+	if err != nil {
+		return nil, err
+	}
+	l.Failover = f
+	if err := b.saveLocked(cfg); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (b *FileBackend) DeleteFailover(hostname, locationId string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cfg, err := b.loadLocked()
+	if err != nil {
+		return err
+	}
+	l, err := b.locationOrErr(cfg, hostname, locationId)
+	if err != nil {
+		return err
+	}
+	l.Failover = nil
+	return b.saveLocked(cfg)
+}
+
+func (b *FileBackend) SetHealthCheck(upstreamId string, hc *HealthCheck) (*HealthCheck, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cfg, err := b.loadLocked()
+	if err != nil {
+		return nil, err
+	}
+	u := b.findUpstream(cfg, upstreamId)
+	if u == nil {
+		return nil, fmt.Errorf("upstream %s not found", upstreamId)
+	}
+	u.HealthCheck = hc
+	if err := b.saveLocked(cfg); err != nil {
+		return nil, err
+	}
+	return hc, nil
+}
+
+func (b *FileBackend) DeleteHealthCheck(upstreamId string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cfg, err := b.loadLocked()
+	if err != nil {
+		return err
+	}
+	u := b.findUpstream(cfg, upstreamId)
+	if u == nil {
+		return fmt.Errorf("upstream %s not found", upstreamId)
+	}
+	u.HealthCheck = nil
+	return b.saveLocked(cfg)
+}
+
+func (b *FileBackend) locationOrErr(cfg *fileConfig, hostname, locationId string) (*fileLocationEntry, error) {
+	h := b.findHost(cfg, hostname)
+	if h == nil {
+		return nil, fmt.Errorf("host %s not found", hostname)
+	}
+	l := b.findLocation(h, locationId)
+	if l == nil {
+		return nil, fmt.Errorf("location %s not found in %s", locationId, hostname)
+	}
+	return l, nil
+}
+
+var _ Backend = &FileBackend{}
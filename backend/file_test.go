@@ -0,0 +1,30 @@
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileBackendConformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vulcand-file-backend-test")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "vulcand.json")
+	if err := ioutil.WriteFile(path, []byte("{}"), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	RunConformanceSuite(t, func() (Backend, func()) {
+		changes := make(chan *Change, 100)
+		b, err := NewFileBackend(path, changes)
+		if err != nil {
+			t.Fatalf("NewFileBackend: %s", err)
+		}
+		return b, func() {}
+	})
+}
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/vulcan/request"
+)
+
+func init() {
+	Register("circuitbreaker", newCircuitBreaker)
+}
+
+// circuitBreakerSpec configures a circuitBreaker. Once at least MinSamples
+// attempts have been observed within WindowSeconds and the error rate
+// reaches ErrorRateThreshold (0..1), the breaker trips open and rejects
+// requests with FallbackStatusCode for CooldownSeconds. Once the cooldown
+// ends, every request is let through again and counting restarts from zero;
+// there is no half-open state that admits a single probe first.
+type circuitBreakerSpec struct {
+	ErrorRateThreshold float64
+	WindowSeconds      int
+	MinSamples         int
+	CooldownSeconds    int
+	FallbackStatusCode int
+}
+
+type circuitBreaker struct {
+	spec circuitBreakerSpec
+
+	mu          sync.Mutex
+	windowStart time.Time
+	total       int
+	errors      int
+	openUntil   time.Time
+}
+
+func newCircuitBreaker(id string, priority int, spec []byte) (interface{}, error) {
+	var s circuitBreakerSpec
+	if err := unmarshalSpec(spec, &s); err != nil {
+		return nil, err
+	}
+	if s.ErrorRateThreshold <= 0 || s.ErrorRateThreshold > 1 {
+		return nil, errMissingField("ErrorRateThreshold in (0, 1]")
+	}
+	if s.WindowSeconds <= 0 {
+		s.WindowSeconds = 10
+	}
+	if s.MinSamples <= 0 {
+		s.MinSamples = 10
+	}
+	if s.CooldownSeconds <= 0 {
+		s.CooldownSeconds = 10
+	}
+	if s.FallbackStatusCode <= 0 {
+		s.FallbackStatusCode = http.StatusServiceUnavailable
+	}
+	return &circuitBreaker{spec: s, windowStart: time.Now()}, nil
+}
+
+func (c *circuitBreaker) Before(r request.Request) (*http.Response, error) {
+	c.mu.Lock()
+	open := time.Now().Before(c.openUntil)
+	c.mu.Unlock()
+	if !open {
+		return nil, nil
+	}
+	req := r.GetHttpRequest()
+	body := "circuit breaker open"
+	return &http.Response{
+		Status:        http.StatusText(c.spec.FallbackStatusCode),
+		StatusCode:    c.spec.FallbackStatusCode,
+		Proto:         req.Proto,
+		ProtoMajor:    req.ProtoMajor,
+		ProtoMinor:    req.ProtoMinor,
+		Request:       req,
+		Header:        http.Header{"Content-Type": []string{"text/plain"}},
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+	}, nil
+}
+
+func (c *circuitBreaker) After(r request.Request, a request.Attempt) {
+	isError := a.GetError() != nil
+	if resp := a.GetResponse(); resp != nil && resp.StatusCode >= 500 {
+		isError = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.windowStart) > time.Duration(c.spec.WindowSeconds)*time.Second {
+		c.windowStart = now
+		c.total = 0
+		c.errors = 0
+	}
+	c.total++
+	if isError {
+		c.errors++
+	}
+	if c.total >= c.spec.MinSamples && float64(c.errors)/float64(c.total) >= c.spec.ErrorRateThreshold {
+		c.openUntil = now.Add(time.Duration(c.spec.CooldownSeconds) * time.Second)
+		c.total = 0
+		c.errors = 0
+	}
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNewCircuitBreakerRequiresErrorRateThreshold(t *testing.T) {
+	if _, err := newCircuitBreaker("c1", 0, []byte(`{}`)); err == nil {
+		t.Fatalf("expected an error when ErrorRateThreshold is missing")
+	}
+	if _, err := newCircuitBreaker("c1", 0, []byte(`{"ErrorRateThreshold":1.5}`)); err == nil {
+		t.Fatalf("expected an error when ErrorRateThreshold is out of (0, 1]")
+	}
+}
+
+func TestNewCircuitBreakerDefaults(t *testing.T) {
+	m, err := newCircuitBreaker("c1", 0, []byte(`{"ErrorRateThreshold":0.5}`))
+	if err != nil {
+		t.Fatalf("newCircuitBreaker: %s", err)
+	}
+	c := m.(*circuitBreaker)
+	if c.spec.WindowSeconds != 10 || c.spec.MinSamples != 10 || c.spec.CooldownSeconds != 10 {
+		t.Fatalf("expected default window/samples/cooldown of 10, got %+v", c.spec)
+	}
+	if c.spec.FallbackStatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected default fallback status 503, got %d", c.spec.FallbackStatusCode)
+	}
+}
+
+func TestCircuitBreakerStaysClosedBelowMinSamples(t *testing.T) {
+	m, err := newCircuitBreaker("c1", 0, []byte(`{"ErrorRateThreshold":0.5,"MinSamples":4}`))
+	if err != nil {
+		t.Fatalf("newCircuitBreaker: %s", err)
+	}
+	c := m.(*circuitBreaker)
+	req := newTestRequest(t)
+
+	for i := 0; i < 3; i++ {
+		c.After(&fakeRequest{httpRequest: req}, &fakeAttempt{response: &http.Response{StatusCode: 500}})
+	}
+
+	resp, err := c.Before(&fakeRequest{httpRequest: req})
+	if err != nil {
+		t.Fatalf("Before: %s", err)
+	}
+	if resp != nil {
+		t.Fatalf("expected the breaker to stay closed below MinSamples, got %+v", resp)
+	}
+}
+
+func TestCircuitBreakerTripsAfterErrorRateThreshold(t *testing.T) {
+	m, err := newCircuitBreaker("c1", 0, []byte(`{"ErrorRateThreshold":0.5,"MinSamples":4,"FallbackStatusCode":503}`))
+	if err != nil {
+		t.Fatalf("newCircuitBreaker: %s", err)
+	}
+	c := m.(*circuitBreaker)
+	req := newTestRequest(t)
+
+	for i := 0; i < 4; i++ {
+		c.After(&fakeRequest{httpRequest: req}, &fakeAttempt{response: &http.Response{StatusCode: 500}})
+	}
+
+	resp, err := c.Before(&fakeRequest{httpRequest: req})
+	if err != nil {
+		t.Fatalf("Before: %s", err)
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the breaker to trip and return 503, got %+v", resp)
+	}
+}
+
+func TestCircuitBreakerCountsTransportErrorsAsFailures(t *testing.T) {
+	m, err := newCircuitBreaker("c1", 0, []byte(`{"ErrorRateThreshold":0.5,"MinSamples":2}`))
+	if err != nil {
+		t.Fatalf("newCircuitBreaker: %s", err)
+	}
+	c := m.(*circuitBreaker)
+	req := newTestRequest(t)
+
+	c.After(&fakeRequest{httpRequest: req}, &fakeAttempt{err: http.ErrHandlerTimeout})
+	c.After(&fakeRequest{httpRequest: req}, &fakeAttempt{err: http.ErrHandlerTimeout})
+
+	resp, err := c.Before(&fakeRequest{httpRequest: req})
+	if err != nil {
+		t.Fatalf("Before: %s", err)
+	}
+	if resp == nil {
+		t.Fatalf("expected the breaker to trip on repeated transport errors")
+	}
+}
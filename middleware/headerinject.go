@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"github.com/mailgun/vulcan/request"
+)
+
+func init() {
+	Register("header.inject", newHeaderInjector)
+}
+
+// headerInjectorSpec configures a headerInjector: Header is added to every
+// response that makes it back to the client.
+type headerInjectorSpec struct {
+	Header string
+	Value  string
+}
+
+type headerInjector struct {
+	spec headerInjectorSpec
+}
+
+func newHeaderInjector(id string, priority int, spec []byte) (interface{}, error) {
+	var s headerInjectorSpec
+	if err := unmarshalSpec(spec, &s); err != nil {
+		return nil, err
+	}
+	if s.Header == "" {
+		return nil, errMissingField("header")
+	}
+	return &headerInjector{spec: s}, nil
+}
+
+func (h *headerInjector) After(r request.Request, a request.Attempt) {
+	resp := a.GetResponse()
+	if resp == nil {
+		return
+	}
+	resp.Header.Set(h.spec.Header, h.spec.Value)
+}
@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNewHeaderInjectorRequiresHeader(t *testing.T) {
+	if _, err := newHeaderInjector("r1", 0, []byte(`{"Value":"1"}`)); err == nil {
+		t.Fatalf("expected an error when header is missing")
+	}
+}
+
+func TestHeaderInjectorAfterSetsResponseHeader(t *testing.T) {
+	m, err := newHeaderInjector("r1", 0, []byte(`{"Header":"X-Injected","Value":"yes"}`))
+	if err != nil {
+		t.Fatalf("newHeaderInjector: %s", err)
+	}
+	h := m.(*headerInjector)
+
+	resp := &http.Response{Header: http.Header{}}
+	h.After(&fakeRequest{httpRequest: newTestRequest(t)}, &fakeAttempt{response: resp})
+
+	if got := resp.Header.Get("X-Injected"); got != "yes" {
+		t.Fatalf("expected X-Injected header to be %q, got %q", "yes", got)
+	}
+}
+
+func TestHeaderInjectorAfterIgnoresNilResponse(t *testing.T) {
+	m, err := newHeaderInjector("r1", 0, []byte(`{"Header":"X-Injected","Value":"yes"}`))
+	if err != nil {
+		t.Fatalf("newHeaderInjector: %s", err)
+	}
+	h := m.(*headerInjector)
+
+	// Should not panic when an attempt has no response, e.g. a connect error.
+	h.After(&fakeRequest{httpRequest: newTestRequest(t)}, &fakeAttempt{})
+}
@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/mailgun/vulcan/request"
+)
+
+func init() {
+	Register("header.rewrite", newHeaderRewriter)
+}
+
+// headerRewriterSpec configures a headerRewriter: Header is set to Value
+// on every forwarded request, replacing any existing values.
+type headerRewriterSpec struct {
+	Header string
+	Value  string
+}
+
+type headerRewriter struct {
+	spec headerRewriterSpec
+}
+
+func newHeaderRewriter(id string, priority int, spec []byte) (interface{}, error) {
+	var s headerRewriterSpec
+	if err := unmarshalSpec(spec, &s); err != nil {
+		return nil, err
+	}
+	if s.Header == "" {
+		return nil, errMissingField("header")
+	}
+	return &headerRewriter{spec: s}, nil
+}
+
+func (h *headerRewriter) Before(r request.Request) (*http.Response, error) {
+	r.GetHttpRequest().Header.Set(h.spec.Header, h.spec.Value)
+	return nil, nil
+}
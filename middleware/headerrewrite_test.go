@@ -0,0 +1,31 @@
+package middleware
+
+import "testing"
+
+func TestNewHeaderRewriterRequiresHeader(t *testing.T) {
+	if _, err := newHeaderRewriter("r1", 0, []byte(`{"Value":"1"}`)); err == nil {
+		t.Fatalf("expected an error when header is missing")
+	}
+}
+
+func TestHeaderRewriterBeforeSetsHeader(t *testing.T) {
+	m, err := newHeaderRewriter("r1", 0, []byte(`{"Header":"X-Test","Value":"rewritten"}`))
+	if err != nil {
+		t.Fatalf("newHeaderRewriter: %s", err)
+	}
+	h := m.(*headerRewriter)
+
+	req := newTestRequest(t)
+	req.Header.Set("X-Test", "original")
+
+	resp, err := h.Before(&fakeRequest{httpRequest: req})
+	if err != nil {
+		t.Fatalf("Before: %s", err)
+	}
+	if resp != nil {
+		t.Fatalf("expected Before to never short-circuit, got %+v", resp)
+	}
+	if got := req.Header.Get("X-Test"); got != "rewritten" {
+		t.Fatalf("expected X-Test to be rewritten to %q, got %q", "rewritten", got)
+	}
+}
@@ -0,0 +1,83 @@
+// Package middleware implements vulcand's pluggable request/response
+// transform chain. Each middleware type registers a Factory that builds
+// an instance from its JSON spec; a location's configured middlewares are
+// instantiated in priority order and wired into the proxy's Before/After
+// callback chains.
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/mailgun/vulcan/request"
+)
+
+// Before is implemented by middlewares that act on a request before it's
+// forwarded upstream. Returning a non-nil response short-circuits the
+// request, e.g. to reject it.
+type Before interface {
+	Before(r request.Request) (*http.Response, error)
+}
+
+// After is implemented by middlewares that act once an attempt has
+// completed, e.g. to inject response headers or record error rates.
+type After interface {
+	After(r request.Request, a request.Attempt)
+}
+
+// Factory builds a middleware instance from its spec. id and priority are
+// passed through so implementations can use them in error messages or
+// metrics; the returned value should implement Before, After, or both.
+type Factory func(id string, priority int, spec []byte) (interface{}, error)
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes a middleware type available by name. It's expected to be
+// called from init() in the package implementing the type.
+func Register(typeName string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[typeName] = factory
+}
+
+// New instantiates the middleware registered under typeName, returning an
+// error if the type is unknown or the spec fails validation.
+func New(typeName, id string, priority int, spec []byte) (interface{}, error) {
+	registryMu.Lock()
+	factory, ok := registry[typeName]
+	registryMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown middleware type: %s", typeName)
+	}
+	instance, err := factory(id, priority, spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid spec for middleware %s (%s): %s", id, typeName, err)
+	}
+	return instance, nil
+}
+
+// Validate instantiates and discards a middleware, to be used by the API
+// layer so a bad spec is rejected before it's written to the backend.
+func Validate(typeName string, spec []byte) error {
+	_, err := New(typeName, "validate", 0, spec)
+	return err
+}
+
+func errMissingField(name string) error {
+	return fmt.Errorf("missing required field: %s", name)
+}
+
+func unmarshalSpec(spec []byte, v interface{}) error {
+	if len(spec) == 0 {
+		return fmt.Errorf("missing spec")
+	}
+	if err := json.Unmarshal(spec, v); err != nil {
+		return fmt.Errorf("bad spec: %s", err)
+	}
+	return nil
+}
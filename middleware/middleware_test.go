@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mailgun/vulcan/request"
+)
+
+// fakeRequest implements request.Request with just the method this
+// package actually calls on it.
+type fakeRequest struct {
+	httpRequest *http.Request
+}
+
+func (r *fakeRequest) GetHttpRequest() *http.Request { return r.httpRequest }
+
+var _ request.Request = &fakeRequest{}
+
+// fakeAttempt implements request.Attempt with just the methods this
+// package actually calls on it.
+type fakeAttempt struct {
+	err      error
+	response *http.Response
+}
+
+func (a *fakeAttempt) GetError() error             { return a.err }
+func (a *fakeAttempt) GetResponse() *http.Response { return a.response }
+func (a *fakeAttempt) GetAttemptNumber() int       { return 1 }
+
+var _ request.Attempt = &fakeAttempt{}
+
+func newTestRequest(t *testing.T) *http.Request {
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %s", err)
+	}
+	return req
+}
+
+func TestRegisterAndNew(t *testing.T) {
+	if _, err := New("header.rewrite", "r1", 0, []byte(`{"Header":"X-Test","Value":"1"}`)); err != nil {
+		t.Fatalf("New: %s", err)
+	}
+}
+
+func TestNewUnknownType(t *testing.T) {
+	if _, err := New("no.such.type", "r1", 0, []byte(`{}`)); err == nil {
+		t.Fatalf("expected an error for an unregistered middleware type")
+	}
+}
+
+func TestValidateRejectsBadSpec(t *testing.T) {
+	if err := Validate("header.rewrite", []byte(`{}`)); err == nil {
+		t.Fatalf("expected an error for a spec missing the required header field")
+	}
+}
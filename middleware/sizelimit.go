@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/mailgun/vulcan/request"
+)
+
+func init() {
+	Register("request.sizelimit", newSizeLimiter)
+}
+
+// sizeLimiterSpec rejects requests whose body is larger than MaxBytes.
+type sizeLimiterSpec struct {
+	MaxBytes int64
+}
+
+type sizeLimiter struct {
+	spec sizeLimiterSpec
+}
+
+func newSizeLimiter(id string, priority int, spec []byte) (interface{}, error) {
+	var s sizeLimiterSpec
+	if err := unmarshalSpec(spec, &s); err != nil {
+		return nil, err
+	}
+	if s.MaxBytes <= 0 {
+		return nil, errMissingField("MaxBytes")
+	}
+	return &sizeLimiter{spec: s}, nil
+}
+
+// Before enforces MaxBytes by actually reading the body up to that limit,
+// rather than trusting a client-supplied Content-Length: a chunked request
+// carries no Content-Length at all (it reads as -1) and would otherwise
+// sail through unchecked.
+func (l *sizeLimiter) Before(r request.Request) (*http.Response, error) {
+	req := r.GetHttpRequest()
+	if req.Body == nil {
+		return nil, nil
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(req.Body, l.spec.MaxBytes+1))
+	req.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %s", err)
+	}
+	if int64(len(buf)) <= l.spec.MaxBytes {
+		req.Body = ioutil.NopCloser(bytes.NewReader(buf))
+		req.ContentLength = int64(len(buf))
+		return nil, nil
+	}
+
+	body := "request entity too large"
+	return &http.Response{
+		Status:        http.StatusText(http.StatusRequestEntityTooLarge),
+		StatusCode:    http.StatusRequestEntityTooLarge,
+		Proto:         req.Proto,
+		ProtoMajor:    req.ProtoMajor,
+		ProtoMinor:    req.ProtoMinor,
+		Request:       req,
+		Header:        http.Header{"Content-Type": []string{"text/plain"}},
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+	}, nil
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewSizeLimiterRequiresMaxBytes(t *testing.T) {
+	if _, err := newSizeLimiter("s1", 0, []byte(`{}`)); err == nil {
+		t.Fatalf("expected an error when MaxBytes is missing")
+	}
+	if _, err := newSizeLimiter("s1", 0, []byte(`{"MaxBytes":0}`)); err == nil {
+		t.Fatalf("expected an error when MaxBytes is non-positive")
+	}
+}
+
+func TestSizeLimiterAllowsBodyWithinLimit(t *testing.T) {
+	m, err := newSizeLimiter("s1", 0, []byte(`{"MaxBytes":10}`))
+	if err != nil {
+		t.Fatalf("newSizeLimiter: %s", err)
+	}
+	l := m.(*sizeLimiter)
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com", strings.NewReader("small"))
+	resp, err := l.Before(&fakeRequest{httpRequest: req})
+	if err != nil {
+		t.Fatalf("Before: %s", err)
+	}
+	if resp != nil {
+		t.Fatalf("expected a within-limit body to pass through, got %+v", resp)
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("ReadAll: %s", err)
+	}
+	if string(body) != "small" {
+		t.Fatalf("expected the body to still be readable downstream, got %q", body)
+	}
+}
+
+func TestSizeLimiterRejectsOversizedChunkedBody(t *testing.T) {
+	m, err := newSizeLimiter("s1", 0, []byte(`{"MaxBytes":4}`))
+	if err != nil {
+		t.Fatalf("newSizeLimiter: %s", err)
+	}
+	l := m.(*sizeLimiter)
+
+	// A chunked request carries no Content-Length (it reads as -1), which
+	// is exactly the case that used to bypass the limiter entirely.
+	req := httptest.NewRequest(http.MethodPost, "http://example.com", strings.NewReader("this body is too long"))
+	req.ContentLength = -1
+
+	resp, err := l.Before(&fakeRequest{httpRequest: req})
+	if err != nil {
+		t.Fatalf("Before: %s", err)
+	}
+	if resp == nil || resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected a 413 response for an oversized chunked body, got %+v", resp)
+	}
+}
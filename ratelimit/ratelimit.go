@@ -0,0 +1,123 @@
+// Package ratelimit implements the token-bucket limiters used to enforce
+// per-location rate limits, bucketed per variable value (e.g. per client
+// IP or per API key).
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// staleAfterPeriods bounds how long an idle bucket is kept before Allow
+// sweeps it out: a key the limiter hasn't seen in this many periods is
+// unlikely to come back before its bucket would've refilled to burst
+// anyway, so there's no harm in forgetting it.
+const staleAfterPeriods = 10
+
+// sweepEveryCalls bounds how often Allow pays for a sweep of the bucket
+// map, so an attacker who can pick the key (e.g. a header or cookie value)
+// can't hold an unbounded number of buckets in memory forever.
+const sweepEveryCalls = 10000
+
+// Limiter enforces a requests/period/burst policy, keeping one token
+// bucket per distinct key it sees.
+type Limiter struct {
+	Id            string
+	Variable      string
+	Requests      int
+	PeriodSeconds int
+	Burst         int
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	calls   int
+}
+
+// New validates the policy and returns a ready-to-use Limiter.
+func New(id, variable string, requests, periodSeconds, burst int) (*Limiter, error) {
+	if requests <= 0 || periodSeconds <= 0 {
+		return nil, fmt.Errorf("ratelimit %s: requests and period_seconds must be positive", id)
+	}
+	if burst <= 0 {
+		burst = requests
+	}
+	return &Limiter{
+		Id:            id,
+		Variable:      variable,
+		Requests:      requests,
+		PeriodSeconds: periodSeconds,
+		Burst:         burst,
+		buckets:       make(map[string]*tokenBucket),
+	}, nil
+}
+
+// Allow reports whether a request identified by key is within the limit,
+// consuming a token if so.
+func (l *Limiter) Allow(key string) bool {
+	l.mu.Lock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newTokenBucket(l.Requests, l.PeriodSeconds, l.Burst)
+		l.buckets[key] = b
+	}
+	l.calls++
+	if l.calls%sweepEveryCalls == 0 {
+		l.sweepLocked()
+	}
+	l.mu.Unlock()
+	return b.take()
+}
+
+// sweepLocked evicts buckets that haven't been touched in staleAfterPeriods
+// periods, bounding how much memory an unbounded key space (e.g. a
+// client-controlled header or cookie value) can hold onto. l.mu must be
+// held by the caller.
+func (l *Limiter) sweepLocked() {
+	staleAfter := time.Duration(l.PeriodSeconds*staleAfterPeriods) * time.Second
+	now := time.Now()
+	for key, b := range l.buckets {
+		b.mu.Lock()
+		stale := now.Sub(b.last) > staleAfter
+		b.mu.Unlock()
+		if stale {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+type tokenBucket struct {
+	rate   float64 // tokens per second
+	burst  float64
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(requests, periodSeconds, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(requests) / float64(periodSeconds),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+
+	b.tokens += elapsed * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
@@ -0,0 +1,115 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewValidatesRequestsAndPeriod(t *testing.T) {
+	if _, err := New("r1", "client.ip", 0, 1, 0); err == nil {
+		t.Fatalf("expected error for non-positive requests")
+	}
+	if _, err := New("r1", "client.ip", 1, 0, 0); err == nil {
+		t.Fatalf("expected error for non-positive period_seconds")
+	}
+}
+
+func TestNewDefaultsBurstToRequests(t *testing.T) {
+	l, err := New("r1", "client.ip", 5, 1, 0)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	if l.Burst != 5 {
+		t.Fatalf("expected burst to default to requests (5), got %d", l.Burst)
+	}
+}
+
+func TestAllowEnforcesBurst(t *testing.T) {
+	l, err := New("r1", "client.ip", 2, 60, 2)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	if !l.Allow("a") {
+		t.Fatalf("expected first request to be allowed")
+	}
+	if !l.Allow("a") {
+		t.Fatalf("expected second request to be allowed (within burst)")
+	}
+	if l.Allow("a") {
+		t.Fatalf("expected third request to be rejected once burst is exhausted")
+	}
+}
+
+func TestAllowRefillsOverTime(t *testing.T) {
+	l, err := New("r1", "client.ip", 1, 1, 1)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	if !l.Allow("a") {
+		t.Fatalf("expected first request to be allowed")
+	}
+	if l.Allow("a") {
+		t.Fatalf("expected second request to be rejected before the bucket refills")
+	}
+
+	b := l.buckets["a"]
+	b.last = b.last.Add(-2 * time.Second)
+
+	if !l.Allow("a") {
+		t.Fatalf("expected request to be allowed after enough time elapsed to refill a token")
+	}
+}
+
+func TestSweepLockedEvictsStaleBuckets(t *testing.T) {
+	l, err := New("r1", "client.ip", 1, 1, 1)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	l.Allow("stale")
+	l.Allow("fresh")
+
+	l.buckets["stale"].last = time.Now().Add(-(staleAfterPeriods + 1) * time.Second)
+
+	l.mu.Lock()
+	l.sweepLocked()
+	l.mu.Unlock()
+
+	if _, ok := l.buckets["stale"]; ok {
+		t.Fatalf("expected the stale bucket to be evicted")
+	}
+	if _, ok := l.buckets["fresh"]; !ok {
+		t.Fatalf("expected the fresh bucket to survive the sweep")
+	}
+}
+
+func TestAllowSweepsPeriodically(t *testing.T) {
+	l, err := New("r1", "client.ip", 1, 1, 1)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	l.Allow("stale")
+	l.buckets["stale"].last = time.Now().Add(-(staleAfterPeriods + 1) * time.Second)
+
+	l.calls = sweepEveryCalls - 1
+	l.Allow("trigger")
+
+	if _, ok := l.buckets["stale"]; ok {
+		t.Fatalf("expected Allow to sweep the stale bucket once the call counter wraps")
+	}
+}
+
+func TestAllowTracksKeysIndependently(t *testing.T) {
+	l, err := New("r1", "client.ip", 1, 60, 1)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	if !l.Allow("a") {
+		t.Fatalf("expected first request for key a to be allowed")
+	}
+	if !l.Allow("b") {
+		t.Fatalf("expected first request for key b to be allowed independently of key a")
+	}
+	if l.Allow("a") {
+		t.Fatalf("expected second request for key a to be rejected")
+	}
+}
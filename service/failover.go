@@ -0,0 +1,195 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mailgun/vulcan/request"
+	. "github.com/mailgun/vulcand/backend"
+)
+
+// buildShouldFailover turns a Failover policy into the predicate vulcan
+// consults after a failed attempt. It only allows a retry when the
+// request is idempotent (or explicitly marked safe to retry), the attempt
+// budget isn't exhausted, and the failure matches one of the configured
+// RetryOn conditions.
+func buildShouldFailover(f *Failover) func(r request.Request, a request.Attempt) bool {
+	return func(r request.Request, a request.Attempt) bool {
+		if f.MaxAttempts <= 0 || a.GetAttemptNumber() >= f.MaxAttempts {
+			return false
+		}
+		if !isRetryable(r.GetHttpRequest()) {
+			return false
+		}
+		return matchesRetryOn(f.RetryOn, a)
+	}
+}
+
+// isRetryable reports whether it's safe to resend req: either it's one of
+// the idempotent HTTP methods, or the caller explicitly opted in with an
+// X-Idempotency-Key header.
+func isRetryable(req *http.Request) bool {
+	if req.Header.Get("X-Idempotency-Key") != "" {
+		return true
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+func matchesRetryOn(retryOn []string, a request.Attempt) bool {
+	err := a.GetError()
+	resp := a.GetResponse()
+	for _, condition := range retryOn {
+		switch {
+		case condition == "connect_error" && err != nil && !isTimeout(err):
+			return true
+		case condition == "read_timeout" && isTimeout(err):
+			return true
+		case condition == "5xx" && resp != nil && resp.StatusCode >= 500:
+			return true
+		case strings.HasPrefix(condition, "http:") && resp != nil:
+			for _, code := range strings.Split(strings.TrimPrefix(condition, "http:"), ",") {
+				if code == strconv.Itoa(resp.StatusCode) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func isTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// bodyBuffer is a Before callback that makes a request's body replayable
+// across retries: it's kept in memory when it fits in maxMemoryBytes,
+// written whole to a temp file when larger, and rejected outright with 413
+// when it exceeds maxTotalBytes.
+type bodyBuffer struct {
+	maxMemoryBytes int64
+	maxTotalBytes  int64
+}
+
+func newBodyBuffer(f *Failover) *bodyBuffer {
+	b := &bodyBuffer{maxMemoryBytes: f.MaxBodyMemoryBytes, maxTotalBytes: f.MaxBodyBytes}
+	if b.maxMemoryBytes <= 0 {
+		b.maxMemoryBytes = 1 << 20 // 1MB
+	}
+	return b
+}
+
+func (b *bodyBuffer) Before(r request.Request) (*http.Response, error) {
+	req := r.GetHttpRequest()
+	if req.Body == nil {
+		return nil, nil
+	}
+	if b.maxTotalBytes > 0 && req.ContentLength > b.maxTotalBytes {
+		return requestEntityTooLarge(req), nil
+	}
+
+	memory, spillPath, err := b.read(req.Body)
+	req.Body.Close()
+	if err == errBodyTooLarge {
+		return requestEntityTooLarge(req), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to buffer request body: %s", err)
+	}
+
+	req.GetBody = func() (io.ReadCloser, error) {
+		if spillPath != "" {
+			return os.Open(spillPath)
+		}
+		return ioutil.NopCloser(bytes.NewReader(memory)), nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = body
+
+	if spillPath != "" {
+		// Attempts are expected to finish well within this window; this is
+		// a best-effort backstop in case a request is abandoned mid-retry.
+		time.AfterFunc(10*time.Minute, func() { os.Remove(spillPath) })
+	}
+	return nil, nil
+}
+
+var errBodyTooLarge = fmt.Errorf("request body exceeds maximum size")
+
+// read returns r in memory when it fits in maxMemoryBytes; otherwise the
+// whole body is written to a temp file and its path returned. Either way a
+// body over maxTotalBytes yields errBodyTooLarge.
+func (b *bodyBuffer) read(r io.Reader) (memory []byte, spillPath string, err error) {
+	limited := io.LimitReader(r, b.maxMemoryBytes+1)
+	buf, err := ioutil.ReadAll(limited)
+	if err != nil {
+		return nil, "", err
+	}
+	if b.maxTotalBytes > 0 && int64(len(buf)) > b.maxTotalBytes {
+		return nil, "", errBodyTooLarge
+	}
+	if int64(len(buf)) <= b.maxMemoryBytes {
+		return buf, "", nil
+	}
+
+	f, err := ioutil.TempFile("", "vulcand-body-")
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	total := int64(len(buf))
+	if _, err := f.Write(buf); err != nil {
+		os.Remove(f.Name())
+		return nil, "", err
+	}
+	var remaining io.Reader = r
+	if b.maxTotalBytes > 0 {
+		remaining = io.LimitReader(r, b.maxTotalBytes-total+1)
+	}
+	n, err := io.Copy(f, remaining)
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, "", err
+	}
+	total += n
+	if b.maxTotalBytes > 0 && total > b.maxTotalBytes {
+		os.Remove(f.Name())
+		return nil, "", errBodyTooLarge
+	}
+	return nil, f.Name(), nil
+}
+
+func requestEntityTooLarge(req *http.Request) *http.Response {
+	body := "request entity too large"
+	return &http.Response{
+		Status:        http.StatusText(http.StatusRequestEntityTooLarge),
+		StatusCode:    http.StatusRequestEntityTooLarge,
+		Proto:         req.Proto,
+		ProtoMajor:    req.ProtoMajor,
+		ProtoMinor:    req.ProtoMinor,
+		Request:       req,
+		Header:        http.Header{"Content-Type": []string{"text/plain"}},
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
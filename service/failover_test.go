@@ -0,0 +1,216 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mailgun/vulcan/request"
+	. "github.com/mailgun/vulcand/backend"
+)
+
+// fakeRequest implements request.Request with just the method vulcan
+// actually exercises on it in this codebase.
+type fakeRequest struct {
+	httpRequest *http.Request
+}
+
+func (r *fakeRequest) GetHttpRequest() *http.Request { return r.httpRequest }
+
+var _ request.Request = &fakeRequest{}
+
+// fakeAttempt implements request.Attempt with just the methods this
+// codebase actually calls on it.
+type fakeAttempt struct {
+	err           error
+	response      *http.Response
+	attemptNumber int
+}
+
+func (a *fakeAttempt) GetError() error             { return a.err }
+func (a *fakeAttempt) GetResponse() *http.Response { return a.response }
+func (a *fakeAttempt) GetAttemptNumber() int       { return a.attemptNumber }
+
+var _ request.Attempt = &fakeAttempt{}
+
+type fakeTimeoutError struct{}
+
+func (fakeTimeoutError) Error() string   { return "i/o timeout" }
+func (fakeTimeoutError) Timeout() bool   { return true }
+func (fakeTimeoutError) Temporary() bool { return true }
+
+func newHttpRequest(method string, headers http.Header) *http.Request {
+	req, err := http.NewRequest(method, "http://example.com", nil)
+	if err != nil {
+		panic(err)
+	}
+	if headers != nil {
+		req.Header = headers
+	}
+	return req
+}
+
+func TestIsRetryable(t *testing.T) {
+	idempotent := []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete}
+	for _, m := range idempotent {
+		if !isRetryable(newHttpRequest(m, nil)) {
+			t.Errorf("expected %s to be retryable", m)
+		}
+	}
+	if isRetryable(newHttpRequest(http.MethodPost, nil)) {
+		t.Errorf("expected POST without an idempotency key to not be retryable")
+	}
+	headers := http.Header{}
+	headers.Set("X-Idempotency-Key", "abc")
+	if !isRetryable(newHttpRequest(http.MethodPost, headers)) {
+		t.Errorf("expected POST with X-Idempotency-Key to be retryable")
+	}
+}
+
+func TestIsTimeout(t *testing.T) {
+	if isTimeout(nil) {
+		t.Errorf("expected nil error to not be a timeout")
+	}
+	if isTimeout(fmt.Errorf("connection refused")) {
+		t.Errorf("expected a plain error to not be a timeout")
+	}
+	if !isTimeout(fakeTimeoutError{}) {
+		t.Errorf("expected a net.Error with Timeout()==true to be a timeout")
+	}
+}
+
+func TestMatchesRetryOn(t *testing.T) {
+	cases := []struct {
+		name     string
+		retryOn  []string
+		attempt  *fakeAttempt
+		expected bool
+	}{
+		{"connect_error matches non-timeout error", []string{"connect_error"}, &fakeAttempt{err: fmt.Errorf("refused")}, true},
+		{"connect_error does not match timeout", []string{"connect_error"}, &fakeAttempt{err: fakeTimeoutError{}}, false},
+		{"read_timeout matches timeout error", []string{"read_timeout"}, &fakeAttempt{err: fakeTimeoutError{}}, true},
+		{"5xx matches server error response", []string{"5xx"}, &fakeAttempt{response: &http.Response{StatusCode: 503}}, true},
+		{"5xx does not match 4xx response", []string{"5xx"}, &fakeAttempt{response: &http.Response{StatusCode: 404}}, false},
+		{"http: list matches listed code", []string{"http:404,429"}, &fakeAttempt{response: &http.Response{StatusCode: 429}}, true},
+		{"http: list does not match unlisted code", []string{"http:404,429"}, &fakeAttempt{response: &http.Response{StatusCode: 500}}, false},
+		{"no conditions never match", nil, &fakeAttempt{err: fmt.Errorf("refused")}, false},
+	}
+	for _, c := range cases {
+		if got := matchesRetryOn(c.retryOn, c.attempt); got != c.expected {
+			t.Errorf("%s: matchesRetryOn() = %v, want %v", c.name, got, c.expected)
+		}
+	}
+}
+
+func TestBuildShouldFailover(t *testing.T) {
+	f := &Failover{MaxAttempts: 2, RetryOn: []string{"5xx"}}
+	shouldFailover := buildShouldFailover(f)
+
+	r := &fakeRequest{httpRequest: newHttpRequest(http.MethodGet, nil)}
+	ok := &fakeAttempt{attemptNumber: 1, response: &http.Response{StatusCode: 503}}
+	if !shouldFailover(r, ok) {
+		t.Errorf("expected failover for an idempotent GET under budget with a matching 5xx")
+	}
+
+	exhausted := &fakeAttempt{attemptNumber: 2, response: &http.Response{StatusCode: 503}}
+	if shouldFailover(r, exhausted) {
+		t.Errorf("expected no failover once MaxAttempts is reached")
+	}
+
+	nonIdempotent := &fakeRequest{httpRequest: newHttpRequest(http.MethodPost, nil)}
+	if shouldFailover(nonIdempotent, ok) {
+		t.Errorf("expected no failover for a non-idempotent request without an idempotency key")
+	}
+
+	noMatch := &fakeAttempt{attemptNumber: 1, response: &http.Response{StatusCode: 404}}
+	if shouldFailover(r, noMatch) {
+		t.Errorf("expected no failover when the failure doesn't match RetryOn")
+	}
+}
+
+func TestBodyBufferReadsSmallBodyInMemory(t *testing.T) {
+	b := newBodyBuffer(&Failover{})
+	memory, spillPath, err := b.read(strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if spillPath != "" {
+		t.Fatalf("expected a small body to stay in memory, got spill file %s", spillPath)
+	}
+	if string(memory) != "hello" {
+		t.Fatalf("expected memory to contain %q, got %q", "hello", memory)
+	}
+}
+
+func TestBodyBufferSpillsLargeBodyToDisk(t *testing.T) {
+	b := &bodyBuffer{maxMemoryBytes: 4}
+	payload := "this is longer than four bytes"
+	_, spillPath, err := b.read(strings.NewReader(payload))
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if spillPath == "" {
+		t.Fatalf("expected a body larger than maxMemoryBytes to spill to disk")
+	}
+	defer func() { _ = ioutil.WriteFile(spillPath, nil, 0644) }()
+
+	got, err := ioutil.ReadFile(spillPath)
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	if string(got) != payload {
+		t.Fatalf("expected spilled file to contain %q, got %q", payload, got)
+	}
+}
+
+func TestBodyBufferRejectsOversizedBody(t *testing.T) {
+	b := &bodyBuffer{maxMemoryBytes: 4, maxTotalBytes: 8}
+	_, _, err := b.read(strings.NewReader("way too much data for the limit"))
+	if err != errBodyTooLarge {
+		t.Fatalf("expected errBodyTooLarge, got %v", err)
+	}
+}
+
+func TestBodyBufferBeforeMakesBodyReplayable(t *testing.T) {
+	b := newBodyBuffer(&Failover{})
+	req := httptest.NewRequest(http.MethodPost, "http://example.com", strings.NewReader("payload"))
+
+	if _, err := b.Before(&fakeRequest{httpRequest: req}); err != nil {
+		t.Fatalf("Before: %s", err)
+	}
+
+	first, err := req.GetBody()
+	if err != nil {
+		t.Fatalf("GetBody: %s", err)
+	}
+	firstBytes, _ := ioutil.ReadAll(first)
+	if string(firstBytes) != "payload" {
+		t.Fatalf("expected first replay to read %q, got %q", "payload", firstBytes)
+	}
+
+	second, err := req.GetBody()
+	if err != nil {
+		t.Fatalf("GetBody (second replay): %s", err)
+	}
+	secondBytes, _ := ioutil.ReadAll(second)
+	if string(secondBytes) != "payload" {
+		t.Fatalf("expected second replay to read %q, got %q", "payload", secondBytes)
+	}
+}
+
+func TestBodyBufferBeforeRejectsOversizedContentLength(t *testing.T) {
+	b := newBodyBuffer(&Failover{MaxBodyBytes: 4})
+	req := httptest.NewRequest(http.MethodPost, "http://example.com", strings.NewReader("payload"))
+	req.ContentLength = int64(len("payload"))
+
+	resp, err := b.Before(&fakeRequest{httpRequest: req})
+	if err != nil {
+		t.Fatalf("Before: %s", err)
+	}
+	if resp == nil || resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected a 413 response, got %+v", resp)
+	}
+}
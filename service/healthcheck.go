@@ -0,0 +1,280 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/mailgun/gotools-log"
+	"github.com/mailgun/vulcan/loadbalance/roundrobin"
+	. "github.com/mailgun/vulcand/backend"
+)
+
+// upstreamHealth tracks the health-check state of every endpoint currently
+// being probed for a single upstream.
+type upstreamHealth struct {
+	hc        *HealthCheck
+	endpoints map[string]*endpointHealth
+}
+
+// endpointHealth is the probing state of a single endpoint: whether it's
+// currently considered healthy, how many consecutive probes agreed, and a
+// channel used to cancel the probe goroutine when the endpoint is deleted.
+type endpointHealth struct {
+	healthy        bool
+	consecutiveOk  int
+	consecutiveBad int
+	stop           chan struct{}
+}
+
+func defaultHealthCheck(hc *HealthCheck) *HealthCheck {
+	out := *hc
+	if out.IntervalMs <= 0 {
+		out.IntervalMs = 5000
+	}
+	if out.TimeoutMs <= 0 {
+		out.TimeoutMs = 1000
+	}
+	if out.UnhealthyThreshold <= 0 {
+		out.UnhealthyThreshold = 2
+	}
+	if out.HealthyThreshold <= 0 {
+		out.HealthyThreshold = 2
+	}
+	if out.ExpectedStatusCode <= 0 {
+		out.ExpectedStatusCode = http.StatusOK
+	}
+	return &out
+}
+
+// setHealthCheck installs hc for upstream and starts probing every
+// endpoint currently serving traffic for it.
+func (s *Service) setHealthCheck(upstream *Upstream, hc *HealthCheck) error {
+	hc = defaultHealthCheck(hc)
+
+	s.healthMu.Lock()
+	uh, ok := s.healthState[upstream.Name]
+	if !ok {
+		uh = &upstreamHealth{endpoints: make(map[string]*endpointHealth)}
+		s.healthState[upstream.Name] = uh
+	}
+	uh.hc = hc
+	s.healthMu.Unlock()
+
+	for _, e := range upstream.Endpoints {
+		s.startProbe(upstream, hc, e)
+	}
+	return nil
+}
+
+// deleteHealthCheck stops probing every endpoint of upstream and forgets
+// its health-check config.
+func (s *Service) deleteHealthCheck(upstream *Upstream) error {
+	s.healthMu.Lock()
+	uh, ok := s.healthState[upstream.Name]
+	delete(s.healthState, upstream.Name)
+	s.healthMu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	for name, eh := range uh.endpoints {
+		close(eh.stop)
+		log.Infof("healthcheck: stopped probing upstream=%s endpoint=%s", upstream.Name, name)
+	}
+	return nil
+}
+
+// startProbe begins probing endpoint e of upstream, unless it's already
+// being probed. If no health check is installed for upstream yet, hc is
+// installed as its config.
+func (s *Service) startProbe(upstream *Upstream, hc *HealthCheck, e *Endpoint) {
+	s.healthMu.Lock()
+	uh, ok := s.healthState[upstream.Name]
+	if !ok {
+		uh = &upstreamHealth{hc: hc, endpoints: make(map[string]*endpointHealth)}
+		s.healthState[upstream.Name] = uh
+	}
+	if _, exists := uh.endpoints[e.Name]; exists {
+		s.healthMu.Unlock()
+		return
+	}
+	eh := &endpointHealth{healthy: true, stop: make(chan struct{})}
+	uh.endpoints[e.Name] = eh
+	s.healthMu.Unlock()
+
+	go s.runProbe(upstream.Name, uh, e, eh)
+}
+
+// stopProbe cancels any in-flight probe for endpoint name of upstreamName,
+// e.g. because the endpoint was just removed from etcd.
+func (s *Service) stopProbe(upstreamName, name string) {
+	s.healthMu.Lock()
+	uh, ok := s.healthState[upstreamName]
+	if !ok {
+		s.healthMu.Unlock()
+		return
+	}
+	eh, ok := uh.endpoints[name]
+	if ok {
+		delete(uh.endpoints, name)
+	}
+	s.healthMu.Unlock()
+
+	if ok {
+		close(eh.stop)
+	}
+}
+
+func (s *Service) runProbe(upstreamName string, uh *upstreamHealth, e *Endpoint, eh *endpointHealth) {
+	client := &http.Client{Timeout: time.Duration(uh.hc.TimeoutMs) * time.Millisecond}
+	ticker := time.NewTicker(time.Duration(uh.hc.IntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	// ctx is cancelled the moment eh.stop fires, so a probe blocked in
+	// client.Do is aborted immediately instead of being left to run out
+	// its timeout after the endpoint is already gone.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-eh.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		select {
+		case <-eh.stop:
+			return
+		case <-ticker.C:
+			ok := probeOnce(ctx, client, e.Url, uh.hc)
+			s.recordProbe(upstreamName, uh, e, eh, ok)
+		}
+	}
+}
+
+func probeOnce(ctx context.Context, client *http.Client, endpointUrl string, hc *HealthCheck) bool {
+	req, err := http.NewRequest("GET", endpointUrl+hc.Path, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == hc.ExpectedStatusCode
+}
+
+// healthTransition folds a single probe result into eh's consecutive
+// success/failure counters and decides whether it flips the endpoint's
+// healthy state, honoring the "never eject the last healthy endpoint"
+// safety net unless hc.AllowRemoveLastEndpoint opts out of it. healthyCount
+// is the number of currently-healthy endpoints on the upstream, evaluated
+// before this probe's result is applied.
+func healthTransition(eh *endpointHealth, hc *HealthCheck, healthyCount int, ok bool) (becameUnhealthy, becameHealthy, refusedEjection bool) {
+	if ok {
+		eh.consecutiveOk++
+		eh.consecutiveBad = 0
+	} else {
+		eh.consecutiveBad++
+		eh.consecutiveOk = 0
+	}
+
+	becameUnhealthy = eh.healthy && eh.consecutiveBad >= hc.UnhealthyThreshold
+	becameHealthy = !eh.healthy && eh.consecutiveOk >= hc.HealthyThreshold
+
+	if becameUnhealthy && !hc.AllowRemoveLastEndpoint && healthyCount <= 1 {
+		becameUnhealthy = false
+		refusedEjection = true
+	}
+	if becameUnhealthy {
+		eh.healthy = false
+	}
+	if becameHealthy {
+		eh.healthy = true
+	}
+	return becameUnhealthy, becameHealthy, refusedEjection
+}
+
+// recordProbe folds the result of a single probe into the endpoint's
+// consecutive success/failure counters and ejects or restores the
+// endpoint when a threshold is crossed.
+func (s *Service) recordProbe(upstreamName string, uh *upstreamHealth, e *Endpoint, eh *endpointHealth, ok bool) {
+	s.healthMu.Lock()
+	becameUnhealthy, becameHealthy, refusedEjection := healthTransition(eh, uh.hc, s.healthyCount(uh), ok)
+	s.healthMu.Unlock()
+
+	if refusedEjection {
+		log.Infof("healthcheck: refusing to eject last healthy endpoint upstream=%s endpoint=%s", upstreamName, e.Name)
+	}
+
+	if becameUnhealthy {
+		log.Infof("healthcheck: ejecting upstream=%s endpoint=%s after %d failed probes", upstreamName, e.Name, uh.hc.UnhealthyThreshold)
+		if err := s.ejectEndpoint(upstreamName, e); err != nil {
+			log.Errorf("healthcheck: failed to eject %s: %s", e, err)
+		}
+	}
+	if becameHealthy {
+		log.Infof("healthcheck: restoring upstream=%s endpoint=%s after %d successful probes", upstreamName, e.Name, uh.hc.HealthyThreshold)
+		if err := s.restoreEndpoint(upstreamName, e); err != nil {
+			log.Errorf("healthcheck: failed to restore %s: %s", e, err)
+		}
+	}
+}
+
+// healthyCount must be called with healthMu held.
+func (s *Service) healthyCount(uh *upstreamHealth) int {
+	count := 0
+	for _, eh := range uh.endpoints {
+		if eh.healthy {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *Service) ejectEndpoint(upstreamName string, e *Endpoint) error {
+	endpoint, err := EndpointFromUrl(e.Name, e.Url)
+	if err != nil {
+		return err
+	}
+	locations, err := s.getLocations(upstreamName)
+	if err != nil {
+		return err
+	}
+	for _, l := range locations {
+		rr, ok := l.GetLoadBalancer().(*roundrobin.RoundRobin)
+		if !ok {
+			return fmt.Errorf("unexpected load balancer type: %T", l.GetLoadBalancer())
+		}
+		if err := rr.RemoveEndpoint(endpoint); err != nil {
+			log.Errorf("healthcheck: failed to remove %s: %s", e, err)
+		}
+	}
+	return nil
+}
+
+func (s *Service) restoreEndpoint(upstreamName string, e *Endpoint) error {
+	endpoint, err := EndpointFromUrl(e.Name, e.Url)
+	if err != nil {
+		return err
+	}
+	locations, err := s.getLocations(upstreamName)
+	if err != nil {
+		return err
+	}
+	for _, l := range locations {
+		rr, ok := l.GetLoadBalancer().(*roundrobin.RoundRobin)
+		if !ok {
+			return fmt.Errorf("unexpected load balancer type: %T", l.GetLoadBalancer())
+		}
+		if err := rr.AddEndpoint(endpoint); err != nil {
+			log.Errorf("healthcheck: failed to restore %s: %s", e, err)
+		}
+	}
+	return nil
+}
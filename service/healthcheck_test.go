@@ -0,0 +1,94 @@
+package service
+
+import (
+	"net/http"
+	"testing"
+
+	. "github.com/mailgun/vulcand/backend"
+)
+
+func TestDefaultHealthCheckFillsInZeroValues(t *testing.T) {
+	out := defaultHealthCheck(&HealthCheck{})
+	if out.IntervalMs != 5000 {
+		t.Errorf("expected default IntervalMs 5000, got %d", out.IntervalMs)
+	}
+	if out.TimeoutMs != 1000 {
+		t.Errorf("expected default TimeoutMs 1000, got %d", out.TimeoutMs)
+	}
+	if out.UnhealthyThreshold != 2 {
+		t.Errorf("expected default UnhealthyThreshold 2, got %d", out.UnhealthyThreshold)
+	}
+	if out.HealthyThreshold != 2 {
+		t.Errorf("expected default HealthyThreshold 2, got %d", out.HealthyThreshold)
+	}
+	if out.ExpectedStatusCode != http.StatusOK {
+		t.Errorf("expected default ExpectedStatusCode 200, got %d", out.ExpectedStatusCode)
+	}
+}
+
+func TestDefaultHealthCheckPreservesSetValues(t *testing.T) {
+	in := &HealthCheck{IntervalMs: 1, TimeoutMs: 2, UnhealthyThreshold: 3, HealthyThreshold: 4, ExpectedStatusCode: 201}
+	out := defaultHealthCheck(in)
+	if *out != *in {
+		t.Errorf("expected explicit values to be preserved, got %+v", out)
+	}
+}
+
+func TestHealthTransitionEjectsAfterUnhealthyThreshold(t *testing.T) {
+	hc := &HealthCheck{UnhealthyThreshold: 2, HealthyThreshold: 2}
+	eh := &endpointHealth{healthy: true}
+
+	becameUnhealthy, becameHealthy, refused := healthTransition(eh, hc, 2, false)
+	if becameUnhealthy || becameHealthy || refused {
+		t.Fatalf("expected no transition after a single failure, got unhealthy=%v healthy=%v refused=%v", becameUnhealthy, becameHealthy, refused)
+	}
+
+	becameUnhealthy, becameHealthy, refused = healthTransition(eh, hc, 2, false)
+	if !becameUnhealthy || becameHealthy || refused {
+		t.Fatalf("expected ejection after UnhealthyThreshold consecutive failures, got unhealthy=%v healthy=%v refused=%v", becameUnhealthy, becameHealthy, refused)
+	}
+	if eh.healthy {
+		t.Fatalf("expected endpoint to be marked unhealthy")
+	}
+}
+
+func TestHealthTransitionRestoresAfterHealthyThreshold(t *testing.T) {
+	hc := &HealthCheck{UnhealthyThreshold: 1, HealthyThreshold: 2}
+	eh := &endpointHealth{healthy: false}
+
+	becameUnhealthy, becameHealthy, refused := healthTransition(eh, hc, 2, true)
+	if becameUnhealthy || becameHealthy || refused {
+		t.Fatalf("expected no transition after a single success, got unhealthy=%v healthy=%v refused=%v", becameUnhealthy, becameHealthy, refused)
+	}
+
+	becameUnhealthy, becameHealthy, refused = healthTransition(eh, hc, 2, true)
+	if becameUnhealthy || !becameHealthy || refused {
+		t.Fatalf("expected restoration after HealthyThreshold consecutive successes, got unhealthy=%v healthy=%v refused=%v", becameUnhealthy, becameHealthy, refused)
+	}
+	if !eh.healthy {
+		t.Fatalf("expected endpoint to be marked healthy")
+	}
+}
+
+func TestHealthTransitionRefusesToEjectLastHealthyEndpoint(t *testing.T) {
+	hc := &HealthCheck{UnhealthyThreshold: 1, HealthyThreshold: 1}
+	eh := &endpointHealth{healthy: true}
+
+	becameUnhealthy, becameHealthy, refused := healthTransition(eh, hc, 1, false)
+	if becameUnhealthy || becameHealthy || !refused {
+		t.Fatalf("expected ejection to be refused when this is the last healthy endpoint, got unhealthy=%v healthy=%v refused=%v", becameUnhealthy, becameHealthy, refused)
+	}
+	if !eh.healthy {
+		t.Fatalf("expected endpoint to remain healthy when ejection is refused")
+	}
+}
+
+func TestHealthTransitionAllowRemoveLastEndpointOverridesRefusal(t *testing.T) {
+	hc := &HealthCheck{UnhealthyThreshold: 1, HealthyThreshold: 1, AllowRemoveLastEndpoint: true}
+	eh := &endpointHealth{healthy: true}
+
+	becameUnhealthy, becameHealthy, refused := healthTransition(eh, hc, 1, false)
+	if !becameUnhealthy || becameHealthy || refused {
+		t.Fatalf("expected ejection to proceed when AllowRemoveLastEndpoint is set, got unhealthy=%v healthy=%v refused=%v", becameUnhealthy, becameHealthy, refused)
+	}
+}
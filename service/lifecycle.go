@@ -0,0 +1,181 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/mailgun/gotools-log"
+)
+
+// envListenFds carries the inherited listener fds across a reload re-exec,
+// as a comma-separated list of "name=fd" pairs (e.g. "proxy=3,api=4").
+const envListenFds = "VULCAND_LISTEN_FDS"
+
+// listen returns a listener for addr. If the environment carries an fd
+// inherited from a parent process for name (see reload), it's reused
+// instead of opening a new socket, so a reload can hand off a listener
+// without a moment where the port isn't accepting connections.
+func (s *Service) listen(name, addr string) (net.Listener, error) {
+	if fd, ok := inheritedFd(name); ok {
+		file := os.NewFile(fd, name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to inherit %s listener (fd %d): %s", name, fd, err)
+		}
+		log.Infof("Inherited %s listener on fd %d", name, fd)
+		return listener, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+func inheritedFd(name string) (uintptr, bool) {
+	for _, pair := range strings.Split(os.Getenv(envListenFds), ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] != name {
+			continue
+		}
+		fd, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, false
+		}
+		return uintptr(fd), true
+	}
+	return 0, false
+}
+
+// waitForSignal blocks until a terminating or reload signal arrives and
+// drives the matching lifecycle transition. SIGINT and SIGTERM shut the
+// service down in place; SIGHUP and SIGUSR2 additionally hand the listening
+// sockets off to a re-execed copy of the binary first, so the replacement
+// can start accepting connections before this process stops.
+func (s *Service) waitForSignal() error {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+
+	for sig := range sigCh {
+		log.Infof("Got signal %s", sig)
+		if sig == syscall.SIGHUP || sig == syscall.SIGUSR2 {
+			if err := s.reload(); err != nil {
+				log.Errorf("Reload failed, continuing to run: %s", err)
+				continue
+			}
+		}
+		return s.shutdown()
+	}
+	return nil
+}
+
+// shutdown stops accepting new connections, drains in-flight ones for up
+// to options.GracefulTimeout, and closes the backend's watch so it can't
+// push more changes into an abandoned channel. Whatever the backend
+// already queued before that point is applied to the router before
+// shutdown returns.
+func (s *Service) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.gracefulTimeout())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := s.proxyServer.Shutdown(ctx); err != nil {
+			log.Errorf("Proxy server shutdown: %s", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := s.apiServer.Shutdown(ctx); err != nil {
+			log.Errorf("Api server shutdown: %s", err)
+		}
+	}()
+	wg.Wait()
+
+	if err := s.backend.Close(); err != nil {
+		log.Errorf("Failed to close backend: %s", err)
+	}
+	close(s.stopWatch)
+	s.drainChanges()
+	return nil
+}
+
+func (s *Service) gracefulTimeout() time.Duration {
+	if s.options.GracefulTimeout > 0 {
+		return s.options.GracefulTimeout
+	}
+	return 30 * time.Second
+}
+
+// drainChanges applies every change already queued on s.changes. It's only
+// safe to call once watchChanges has stopped reading from the channel, and
+// once the backend has stopped producing new changes, so it sees a finite
+// backlog rather than an endless stream.
+func (s *Service) drainChanges() {
+	for {
+		select {
+		case change := <-s.changes:
+			log.Infof("Draining change before exit: %s", change)
+			s.processChange(change)
+		default:
+			return
+		}
+	}
+}
+
+// reload hands the proxy and api listeners off to a re-execed copy of the
+// running binary, passed as inherited file descriptors named by
+// envListenFds, then leaves this process to keep serving until shutdown
+// drains it. The new process binds no new sockets, so there's no window
+// where the ports aren't accepting connections.
+func (s *Service) reload() error {
+	proxyFile, err := listenerFile(s.proxyListener)
+	if err != nil {
+		return fmt.Errorf("failed to extract proxy listener fd: %s", err)
+	}
+	defer proxyFile.Close()
+
+	apiFile, err := listenerFile(s.apiListener)
+	if err != nil {
+		return fmt.Errorf("failed to extract api listener fd: %s", err)
+	}
+	defer apiFile.Close()
+
+	execPath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to resolve executable path: %s", err)
+	}
+
+	env := append(os.Environ(), fmt.Sprintf("%s=proxy=3,api=4", envListenFds))
+	process, err := os.StartProcess(execPath, os.Args, &os.ProcAttr{
+		Dir:   ".",
+		Env:   env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, proxyFile, apiFile},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to re-exec: %s", err)
+	}
+	log.Infof("Re-execed as pid %d, handed off listeners", process.Pid)
+	return nil
+}
+
+// listenerFile extracts the underlying *os.File of a net.Listener so its
+// fd can be passed to a child process. Both TCPListener and the
+// net.FileListener result returned by listen implement this.
+func listenerFile(listener net.Listener) (*os.File, error) {
+	type filer interface {
+		File() (*os.File, error)
+	}
+	f, ok := listener.(filer)
+	if !ok {
+		return nil, fmt.Errorf("listener type %T does not support fd extraction", listener)
+	}
+	return f.File()
+}
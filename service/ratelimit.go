@@ -0,0 +1,86 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mailgun/vulcan/request"
+	. "github.com/mailgun/vulcand/backend"
+	"github.com/mailgun/vulcand/ratelimit"
+)
+
+// rateLimitChain is a vulcan Before callback that runs every rate limit
+// configured on a location, in order, and short-circuits with 429 on the
+// first one that rejects the request.
+type rateLimitChain struct {
+	limiters []*ratelimit.Limiter
+}
+
+func newRateLimitChain(rateLimits []*RateLimit) (*rateLimitChain, error) {
+	c := &rateLimitChain{}
+	for _, rl := range rateLimits {
+		limiter, err := ratelimit.New(rl.Id, rl.Variable, rl.Requests, rl.PeriodSeconds, rl.Burst)
+		if err != nil {
+			return nil, err
+		}
+		c.limiters = append(c.limiters, limiter)
+	}
+	return c, nil
+}
+
+func (c *rateLimitChain) Before(r request.Request) (*http.Response, error) {
+	req := r.GetHttpRequest()
+	for _, limiter := range c.limiters {
+		key, err := rateLimitKey(limiter.Variable, req)
+		if err != nil {
+			return nil, err
+		}
+		if !limiter.Allow(key) {
+			return tooManyRequests(req), nil
+		}
+	}
+	return nil, nil
+}
+
+func tooManyRequests(req *http.Request) *http.Response {
+	body := "Rate limit exceeded"
+	return &http.Response{
+		Status:        http.StatusText(http.StatusTooManyRequests),
+		StatusCode:    http.StatusTooManyRequests,
+		Proto:         req.Proto,
+		ProtoMajor:    req.ProtoMajor,
+		ProtoMinor:    req.ProtoMinor,
+		Request:       req,
+		Header:        http.Header{"Content-Type": []string{"text/plain"}},
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// rateLimitKey resolves a rate limit's "variable" setting to the value
+// used to bucket a given request, e.g. "client.ip" or
+// "request.header.X-Api-Key".
+func rateLimitKey(variable string, req *http.Request) (string, error) {
+	switch {
+	case variable == "client.ip":
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return req.RemoteAddr, nil
+		}
+		return host, nil
+	case strings.HasPrefix(variable, "request.header."):
+		return req.Header.Get(strings.TrimPrefix(variable, "request.header.")), nil
+	case strings.HasPrefix(variable, "request.cookie."):
+		name := strings.TrimPrefix(variable, "request.cookie.")
+		cookie, err := req.Cookie(name)
+		if err != nil {
+			return "", nil
+		}
+		return cookie.Value, nil
+	default:
+		return "", fmt.Errorf("unsupported ratelimit variable: %s", variable)
+	}
+}
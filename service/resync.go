@@ -0,0 +1,219 @@
+package service
+
+import (
+	"reflect"
+
+	log "github.com/mailgun/gotools-log"
+	. "github.com/mailgun/vulcand/backend"
+)
+
+func (s *Service) rememberHost(name string) {
+	s.currentMu.Lock()
+	defer s.currentMu.Unlock()
+	s.current[name] = &Host{Name: name}
+}
+
+func (s *Service) forgetHost(name string) {
+	s.currentMu.Lock()
+	defer s.currentMu.Unlock()
+	delete(s.current, name)
+}
+
+func (s *Service) rememberLocation(hostname string, loc *Location) {
+	s.currentMu.Lock()
+	defer s.currentMu.Unlock()
+	host, ok := s.current[hostname]
+	if !ok {
+		host = &Host{Name: hostname}
+		s.current[hostname] = host
+	}
+	for _, l := range host.Locations {
+		if l.Name == loc.Name {
+			return
+		}
+	}
+	host.Locations = append(host.Locations, loc)
+}
+
+func (s *Service) forgetLocation(hostname, name string) {
+	s.currentMu.Lock()
+	defer s.currentMu.Unlock()
+	host, ok := s.current[hostname]
+	if !ok {
+		return
+	}
+	out := host.Locations[:0]
+	for _, l := range host.Locations {
+		if l.Name != name {
+			out = append(out, l)
+		}
+	}
+	host.Locations = out
+}
+
+// updateCurrentLocation replaces an already-remembered location's snapshot
+// with loc, once it's been resynced against the router. Without this, the
+// baseline a later resync diffs against would stay pinned to whatever
+// addLocation first saw, so an unrelated resync (e.g. the etcd backend's
+// recursive watch firing for any write anywhere under its prefix) would
+// keep comparing against stale options and endpoints forever, re-applying
+// the same no-op update on every pass.
+func (s *Service) updateCurrentLocation(hostname string, loc *Location) {
+	s.currentMu.Lock()
+	defer s.currentMu.Unlock()
+	host, ok := s.current[hostname]
+	if !ok {
+		return
+	}
+	for i, l := range host.Locations {
+		if l.Name == loc.Name {
+			host.Locations[i] = loc
+			return
+		}
+	}
+}
+
+// resync reconciles the router against a full snapshot from the backend,
+// issuing the minimal set of add/delete calls needed to match it. It's
+// used by backends (like the file backend) that can't report precise
+// incremental changes.
+func (s *Service) resync(hosts []*Host) error {
+	s.currentMu.Lock()
+	current := s.current
+	s.currentMu.Unlock()
+
+	fresh := make(map[string]*Host, len(hosts))
+	for _, h := range hosts {
+		fresh[h.Name] = h
+	}
+
+	for name := range current {
+		if _, ok := fresh[name]; !ok {
+			if err := s.deleteHost(&Host{Name: name}); err != nil {
+				log.Errorf("resync: failed to remove host %s: %s", name, err)
+			}
+		}
+	}
+
+	for _, host := range hosts {
+		oldHost, existed := current[host.Name]
+		if !existed {
+			if err := s.addHost(host); err != nil {
+				log.Errorf("resync: failed to add host %s: %s", host.Name, err)
+				continue
+			}
+			oldHost = &Host{Name: host.Name}
+		}
+		s.resyncLocations(host, oldHost)
+	}
+	return nil
+}
+
+func (s *Service) resyncLocations(host, oldHost *Host) {
+	oldByName := make(map[string]*Location, len(oldHost.Locations))
+	for _, l := range oldHost.Locations {
+		oldByName[l.Name] = l
+	}
+
+	freshByName := make(map[string]bool, len(host.Locations))
+	for _, loc := range host.Locations {
+		freshByName[loc.Name] = true
+		old, existed := oldByName[loc.Name]
+		if !existed {
+			if err := s.addLocation(host, loc); err != nil {
+				log.Errorf("resync: failed to add location %s: %s", loc, err)
+			}
+			continue
+		}
+		// A new path or upstream can't be applied to the mounted location in
+		// place, so the location is removed and added again.
+		if old.Path != loc.Path || (old.Upstream != nil && loc.Upstream != nil && old.Upstream.Name != loc.Upstream.Name) {
+			if err := s.deleteLocation(host, old); err != nil {
+				log.Errorf("resync: failed to remove location %s: %s", old, err)
+			}
+			if err := s.addLocation(host, loc); err != nil {
+				log.Errorf("resync: failed to add location %s: %s", loc, err)
+			}
+			continue
+		}
+		s.resyncEndpoints(old, loc)
+		s.resyncHealthCheck(old, loc)
+		if locationOptionsChanged(old, loc) {
+			if err := s.updateLocationOptions(loc); err != nil {
+				log.Errorf("resync: failed to update options for %s: %s", loc, err)
+			}
+		}
+		s.updateCurrentLocation(host.Name, loc)
+	}
+
+	for name, old := range oldByName {
+		if !freshByName[name] {
+			if err := s.deleteLocation(host, old); err != nil {
+				log.Errorf("resync: failed to remove location %s: %s", old, err)
+			}
+		}
+	}
+}
+
+// locationOptionsChanged reports whether a location's rate limits,
+// middlewares, or failover policy differ between two snapshots of it, so
+// resync knows to push rebuilt httploc.Options to the already-running
+// location rather than leaving it on its original settings forever.
+func locationOptionsChanged(old, fresh *Location) bool {
+	return !reflect.DeepEqual(old.RateLimits, fresh.RateLimits) ||
+		!reflect.DeepEqual(old.Middlewares, fresh.Middlewares) ||
+		!reflect.DeepEqual(old.Failover, fresh.Failover)
+}
+
+// resyncHealthCheck diffs an existing location's upstream health check
+// against its fresh snapshot, since a resync-only backend reports a
+// SetHealthCheck/DeleteHealthCheck call the same way it reports
+// everything else: as part of a full snapshot, never as a dedicated
+// *HealthCheck Change.
+func (s *Service) resyncHealthCheck(old, fresh *Location) {
+	if old.Upstream == nil || fresh.Upstream == nil {
+		return
+	}
+	oldHc, freshHc := old.Upstream.HealthCheck, fresh.Upstream.HealthCheck
+	if reflect.DeepEqual(oldHc, freshHc) {
+		return
+	}
+	if freshHc == nil {
+		if err := s.deleteHealthCheck(fresh.Upstream); err != nil {
+			log.Errorf("resync: failed to delete health check for %s: %s", fresh.Upstream, err)
+		}
+		return
+	}
+	if err := s.setHealthCheck(fresh.Upstream, freshHc); err != nil {
+		log.Errorf("resync: failed to update health check for %s: %s", fresh.Upstream, err)
+	}
+}
+
+// resyncEndpoints diffs the endpoints behind an existing location's
+// upstream against its fresh snapshot, adding new or changed endpoints
+// and removing those that are gone.
+func (s *Service) resyncEndpoints(old, fresh *Location) {
+	if old.Upstream == nil || fresh.Upstream == nil {
+		return
+	}
+	oldByName := make(map[string]*Endpoint, len(old.Upstream.Endpoints))
+	for _, e := range old.Upstream.Endpoints {
+		oldByName[e.Name] = e
+	}
+	freshByName := make(map[string]bool, len(fresh.Upstream.Endpoints))
+	for _, e := range fresh.Upstream.Endpoints {
+		freshByName[e.Name] = true
+		if old, existed := oldByName[e.Name]; !existed || old.Url != e.Url {
+			if err := s.addEndpoint(fresh.Upstream, e); err != nil {
+				log.Errorf("resync: failed to add endpoint %s: %s", e, err)
+			}
+		}
+	}
+	for name, e := range oldByName {
+		if !freshByName[name] {
+			if err := s.deleteEndpoint(fresh.Upstream, e); err != nil {
+				log.Errorf("resync: failed to remove endpoint %s: %s", e, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package service
+
+import (
+	"testing"
+
+	. "github.com/mailgun/vulcand/backend"
+)
+
+func TestUpdateCurrentLocationReplacesExistingSnapshot(t *testing.T) {
+	s := NewService(Options{})
+	old := &Location{Name: "loc1", Path: "/old"}
+	s.current["host1"] = &Host{Name: "host1", Locations: []*Location{old}}
+
+	fresh := &Location{Name: "loc1", Path: "/new"}
+	s.updateCurrentLocation("host1", fresh)
+
+	if got := s.current["host1"].Locations[0]; got != fresh {
+		t.Fatalf("expected the stored location to be replaced with the fresh snapshot, got %+v", got)
+	}
+}
+
+func TestUpdateCurrentLocationIgnoresUnknownHost(t *testing.T) {
+	s := NewService(Options{})
+	// Should not panic when the host isn't tracked.
+	s.updateCurrentLocation("no-such-host", &Location{Name: "loc1"})
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"testing"
+
+	. "github.com/mailgun/vulcand/backend"
+)
+
+func TestResyncHealthCheckAddsWhenUpstreamGainsOne(t *testing.T) {
+	s := NewService(Options{})
+	old := &Location{Upstream: &Upstream{Name: "up1"}}
+	hc := &HealthCheck{UnhealthyThreshold: 2, HealthyThreshold: 2}
+	fresh := &Location{Upstream: &Upstream{Name: "up1", HealthCheck: hc}}
+
+	s.resyncHealthCheck(old, fresh)
+
+	if _, ok := s.healthState["up1"]; !ok {
+		t.Fatalf("expected resyncHealthCheck to install a health check for upstream up1")
+	}
+}
+
+func TestResyncHealthCheckRemovesWhenUpstreamLosesOne(t *testing.T) {
+	s := NewService(Options{})
+	hc := &HealthCheck{UnhealthyThreshold: 2, HealthyThreshold: 2}
+	old := &Location{Upstream: &Upstream{Name: "up1", HealthCheck: hc}}
+	fresh := &Location{Upstream: &Upstream{Name: "up1"}}
+
+	if err := s.setHealthCheck(old.Upstream, hc); err != nil {
+		t.Fatalf("setHealthCheck: %s", err)
+	}
+
+	s.resyncHealthCheck(old, fresh)
+
+	if _, ok := s.healthState["up1"]; ok {
+		t.Fatalf("expected resyncHealthCheck to remove the health check for upstream up1")
+	}
+}
+
+func TestResyncHealthCheckNoOpsWhenUnchanged(t *testing.T) {
+	s := NewService(Options{})
+	hc := &HealthCheck{UnhealthyThreshold: 2, HealthyThreshold: 2}
+	old := &Location{Upstream: &Upstream{Name: "up1", HealthCheck: hc}}
+	fresh := &Location{Upstream: &Upstream{Name: "up1", HealthCheck: &HealthCheck{UnhealthyThreshold: 2, HealthyThreshold: 2}}}
+
+	// Should not touch healthState at all: no entry should appear.
+	s.resyncHealthCheck(old, fresh)
+
+	if _, ok := s.healthState["up1"]; ok {
+		t.Fatalf("expected no-op for an unchanged health check, got an installed entry")
+	}
+}
@@ -2,11 +2,11 @@ package service
 
 import (
 	"fmt"
-	"github.com/coreos/go-etcd/etcd"
 	"github.com/gorilla/mux"
 	log "github.com/mailgun/gotools-log"
 	runtime "github.com/mailgun/gotools-runtime"
 	"github.com/mailgun/vulcan"
+	"github.com/mailgun/vulcan/callback"
 	"github.com/mailgun/vulcan/loadbalance/roundrobin"
 	"github.com/mailgun/vulcan/location/httploc"
 	"github.com/mailgun/vulcan/netutils"
@@ -14,27 +14,46 @@ import (
 	"github.com/mailgun/vulcan/route/pathroute"
 	"github.com/mailgun/vulcand/api"
 	. "github.com/mailgun/vulcand/backend"
+	"github.com/mailgun/vulcand/middleware"
+	"net"
 	"net/http"
 	"net/url"
-	"os"
-	"os/signal"
+	"sort"
+	"sync"
 	"time"
 )
 
 type Service struct {
-	client    *etcd.Client
 	proxy     *vulcan.Proxy
 	backend   Backend
 	options   Options
 	router    *hostroute.HostRouter
 	apiRouter *mux.Router
 	changes   chan *Change
+	stopWatch chan struct{}
+
+	proxyListener net.Listener
+	apiListener   net.Listener
+	proxyServer   *http.Server
+	apiServer     *http.Server
+
+	healthMu    sync.Mutex
+	healthState map[string]*upstreamHealth
+
+	// currentMu guards current, the service's own record of what's been
+	// applied to the router. It's consulted by resync to compute a
+	// minimal diff against a backend's full-resync snapshot.
+	currentMu sync.Mutex
+	current   map[string]*Host
 }
 
 func NewService(options Options) *Service {
 	return &Service{
-		options: options,
-		changes: make(chan *Change),
+		options:     options,
+		changes:     make(chan *Change),
+		stopWatch:   make(chan struct{}),
+		healthState: make(map[string]*upstreamHealth),
+		current:     make(map[string]*Host),
 	}
 }
 
@@ -42,7 +61,7 @@ func (s *Service) Start() error {
 	// Init logging
 	log.Init([]*log.LogConfig{&log.LogConfig{Name: "console"}})
 
-	backend, err := NewEtcdBackend(s.options.EtcdNodes, s.options.EtcdKey, s.options.EtcdConsistency, s.changes)
+	backend, err := newBackend(s.options, s.changes)
 	if err != nil {
 		return err
 	}
@@ -66,16 +85,48 @@ func (s *Service) Start() error {
 		return err
 	}
 
+	proxyListener, err := s.listen("proxy", fmt.Sprintf("%s:%d", s.options.Interface, s.options.Port))
+	if err != nil {
+		return fmt.Errorf("failed to listen for proxy: %s", err)
+	}
+	apiListener, err := s.listen("api", fmt.Sprintf("%s:%d", s.options.ApiInterface, s.options.ApiPort))
+	if err != nil {
+		return fmt.Errorf("failed to listen for api: %s", err)
+	}
+	s.proxyListener = proxyListener
+	s.apiListener = apiListener
+
+	s.proxyServer = &http.Server{
+		Handler:        s.proxy,
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	s.apiServer = &http.Server{
+		Handler:        s.apiRouter,
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+
 	go s.startProxy()
 	go s.startApi()
 	go s.watchChanges()
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	return s.waitForSignal()
+}
 
-	// Block until a signal is received.
-	log.Infof("Got signal %s, exiting now", <-c)
-	return nil
+// newBackend constructs the configuration store selected by
+// options.BackendType, defaulting to the etcd backend.
+func newBackend(options Options, changes chan *Change) (Backend, error) {
+	switch options.BackendType {
+	case "", EtcdBackendType:
+		return NewEtcdBackend(options.EtcdNodes, options.EtcdKey, options.EtcdConsistency, changes)
+	case FileBackendType:
+		return NewFileBackend(options.FilePath, changes)
+	default:
+		return nil, fmt.Errorf("unknown backend type: %s", options.BackendType)
+	}
 }
 
 func (s *Service) createProxy() error {
@@ -139,15 +190,57 @@ func (s *Service) configureLocation(loc *Location) error {
 
 func (s *Service) watchChanges() {
 	for {
-		change := <-s.changes
-		log.Infof("Service got change: %s", change)
-		s.processChange(change)
+		select {
+		case change := <-s.changes:
+			log.Infof("Service got change: %s", change)
+			s.processChange(change)
+		case <-s.stopWatch:
+			return
+		}
 	}
 }
 
 func (s *Service) processChange(change *Change) {
 	var err error
 	switch child := (change.Child).(type) {
+	case []*Host:
+		if change.Action == ResyncAction {
+			err = s.resync(child)
+		}
+	case *HealthCheck:
+		upstream := (change.Parent).(*Upstream)
+		switch change.Action {
+		case "create", "update":
+			err = s.setHealthCheck(upstream, child)
+		case "delete":
+			err = s.deleteHealthCheck(upstream)
+		}
+	case *RateLimit:
+		loc := (change.Parent).(*Location)
+		switch change.Action {
+		case "create", "update":
+			err = s.addRateLimit(loc, child)
+		case "delete":
+			err = s.deleteRateLimit(loc, child)
+		}
+	case *Middleware:
+		loc := (change.Parent).(*Location)
+		switch change.Action {
+		case "create", "update":
+			err = s.addMiddleware(loc, child)
+		case "delete":
+			err = s.deleteMiddleware(loc, child)
+		}
+	case *Failover:
+		loc := (change.Parent).(*Location)
+		switch change.Action {
+		case "create", "update":
+			loc.Failover = child
+			err = s.setFailover(loc)
+		case "delete":
+			loc.Failover = nil
+			err = s.deleteFailover(loc)
+		}
 	case *Endpoint:
 		switch change.Action {
 		case "create":
@@ -238,10 +331,15 @@ func (s *Service) addEndpoint(upstream *Upstream, e *Endpoint) error {
 			log.Infof("Added %s", e)
 		}
 	}
+	if upstream.HealthCheck != nil {
+		s.startProbe(upstream, upstream.HealthCheck, e)
+	}
 	return nil
 }
 
 func (s *Service) deleteEndpoint(upstream *Upstream, e *Endpoint) error {
+	s.stopProbe(upstream.Name, e.Name)
+
 	endpoint, err := EndpointFromUrl(e.Name, "http://delete.me:4000")
 	if err != nil {
 		return fmt.Errorf("Failed to parse endpoint url: %s", endpoint)
@@ -274,8 +372,12 @@ func (s *Service) addLocation(host *Host, loc *Location) error {
 	if err != nil {
 		return err
 	}
+	options, err := s.locationOptions(loc)
+	if err != nil {
+		return err
+	}
 	// Create a location itself
-	location, err := httploc.NewLocation(loc.Name, rr)
+	location, err := httploc.NewLocationWithOptions(loc.Name, rr, options)
 	if err != nil {
 		return err
 	}
@@ -283,10 +385,130 @@ func (s *Service) addLocation(host *Host, loc *Location) error {
 	if err := router.AddLocation(loc.Path, location); err != nil {
 		return err
 	}
+	s.rememberLocation(host.Name, loc)
 	// Once the location added, configure all endpoints
 	return s.configureLocation(loc)
 }
 
+// locationOptions builds the httploc.Options a Location should run with:
+// body buffering and failover, then rate limits, then its middlewares in
+// priority order.
+func (s *Service) locationOptions(loc *Location) (httploc.Options, error) {
+	rateLimits, err := newRateLimitChain(loc.RateLimits)
+	if err != nil {
+		return httploc.Options{}, err
+	}
+	middlewares, err := buildMiddlewares(loc.Middlewares)
+	if err != nil {
+		return httploc.Options{}, err
+	}
+
+	before := callback.NewBeforeChain()
+	var options httploc.Options
+	if loc.Failover != nil {
+		before.Add("bodybuffer", newBodyBuffer(loc.Failover))
+		options.ShouldFailover = buildShouldFailover(loc.Failover)
+		if loc.Failover.PerTryTimeoutMs > 0 {
+			options.PerTryTimeout = time.Duration(loc.Failover.PerTryTimeoutMs) * time.Millisecond
+		}
+		if loc.Failover.HedgeAfterMs > 0 {
+			options.HedgeTimeout = time.Duration(loc.Failover.HedgeAfterMs) * time.Millisecond
+		}
+	}
+	if len(loc.RateLimits) > 0 {
+		before.Add("ratelimits", rateLimits)
+	}
+	after := callback.NewAfterChain()
+	for _, m := range middlewares {
+		if b, ok := m.instance.(middleware.Before); ok {
+			before.Add(m.id, b)
+		}
+		if a, ok := m.instance.(middleware.After); ok {
+			after.Add(m.id, a)
+		}
+	}
+	options.Before = before
+	options.After = after
+	return options, nil
+}
+
+type builtMiddleware struct {
+	id       string
+	priority int
+	instance interface{}
+}
+
+// buildMiddlewares instantiates every middleware configured on a location,
+// sorted by priority (lowest first).
+func buildMiddlewares(middlewares []*Middleware) ([]builtMiddleware, error) {
+	out := make([]builtMiddleware, 0, len(middlewares))
+	for _, m := range middlewares {
+		instance, err := middleware.New(m.Type, m.Id, m.Priority, m.Spec)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, builtMiddleware{id: m.Id, priority: m.Priority, instance: instance})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].priority < out[j].priority })
+	return out, nil
+}
+
+// getLocation returns the running httploc.HttpLocation for loc, or an
+// error if it isn't mounted on the router.
+func (s *Service) getLocation(hostname, name string) (*httploc.HttpLocation, error) {
+	router, err := s.getPathRouter(hostname)
+	if err != nil {
+		return nil, err
+	}
+	ilo := router.GetLocationById(name)
+	if ilo == nil {
+		return nil, fmt.Errorf("location %s not found in %s", name, hostname)
+	}
+	location, ok := ilo.(*httploc.HttpLocation)
+	if !ok {
+		return nil, fmt.Errorf("unsupported location type: %T", ilo)
+	}
+	return location, nil
+}
+
+// updateLocationOptions rebuilds a running location's options, e.g. after
+// a rate limit was added, changed or removed.
+func (s *Service) updateLocationOptions(loc *Location) error {
+	location, err := s.getLocation(loc.Hostname, loc.Name)
+	if err != nil {
+		return err
+	}
+	options, err := s.locationOptions(loc)
+	if err != nil {
+		return err
+	}
+	return location.SetOptions(options)
+}
+
+func (s *Service) addRateLimit(loc *Location, rl *RateLimit) error {
+	return s.updateLocationOptions(loc)
+}
+
+func (s *Service) deleteRateLimit(loc *Location, rl *RateLimit) error {
+	return s.updateLocationOptions(loc)
+}
+
+func (s *Service) addMiddleware(loc *Location, m *Middleware) error {
+	return s.updateLocationOptions(loc)
+}
+
+func (s *Service) deleteMiddleware(loc *Location, m *Middleware) error {
+	return s.updateLocationOptions(loc)
+}
+
+func (s *Service) setFailover(loc *Location) error {
+	return s.updateLocationOptions(loc)
+}
+
+func (s *Service) deleteFailover(loc *Location) error {
+	return s.updateLocationOptions(loc)
+}
+
 func (s *Service) deleteLocation(host *Host, loc *Location) error {
 	router, err := s.getPathRouter(host.Name)
 	if err != nil {
@@ -298,6 +520,7 @@ func (s *Service) deleteLocation(host *Host, loc *Location) error {
 	}
 	err = router.RemoveLocation(location)
 	if err == nil {
+		s.forgetLocation(host.Name, loc.Name)
 		log.Infof("Removed %s", loc)
 	}
 	return err
@@ -305,38 +528,30 @@ func (s *Service) deleteLocation(host *Host, loc *Location) error {
 
 func (s *Service) addHost(host *Host) error {
 	router := pathroute.NewPathRouter()
-	return s.router.SetRouter(host.Name, router)
+	if err := s.router.SetRouter(host.Name, router); err != nil {
+		return err
+	}
+	s.rememberHost(host.Name)
+	return nil
 }
 
 func (s *Service) deleteHost(host *Host) error {
 	s.router.RemoveRouter(host.Name)
+	s.forgetHost(host.Name)
 	log.Infof("Removed %s", host)
 	return nil
 }
 
-func (s *Service) startProxy() error {
-	addr := fmt.Sprintf("%s:%d", s.options.Interface, s.options.Port)
-	server := &http.Server{
-		Addr:           addr,
-		Handler:        s.proxy,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
+func (s *Service) startProxy() {
+	if err := s.proxyServer.Serve(s.proxyListener); err != nil && err != http.ErrServerClosed {
+		log.Errorf("Proxy server stopped: %s", err)
 	}
-	return server.ListenAndServe()
 }
 
-func (s *Service) startApi() error {
-	addr := fmt.Sprintf("%s:%d", s.options.ApiInterface, s.options.ApiPort)
-
-	server := &http.Server{
-		Addr:           addr,
-		Handler:        s.apiRouter,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
+func (s *Service) startApi() {
+	if err := s.apiServer.Serve(s.apiListener); err != nil && err != http.ErrServerClosed {
+		log.Errorf("Api server stopped: %s", err)
 	}
-	return server.ListenAndServe()
 }
 
 type VulcanEndpoint struct {
@@ -362,4 +577,4 @@ func (e *VulcanEndpoint) GetId() string {
 
 func (e *VulcanEndpoint) GetUrl() *url.URL {
 	return e.Url
-}
\ No newline at end of file
+}